@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -11,21 +11,27 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/averageNetAdmin/andproxy/internal/handler"
+	"github.com/averageNetAdmin/andproxy/internal/control"
 )
 
 func main() {
-	// Create handler from file and run it
-	// TODO: add code for reading all handlers from directory
-	h, err := handler.NewHandler("/etc/andproxy/handlers/http_80")
-	if err != nil {
-		fmt.Println(err)
+	configPath := flag.String("config", "/etc/andproxy/config.yml", "main config file")
+	configDir := flag.String("config-dir", "/etc/andproxy/handlers", "directory with handler files")
+	socketPath := flag.String("socket", control.SocketPath, "control socket")
+	checkOnly := flag.Bool("check", false, "check config and handler files, print summary and exit")
+	flag.Parse()
+
+	// Only parse configs, nothing is bound or created
+	if *checkOnly {
+		os.Exit(check(*configPath, *configDir))
 	}
-	h.Listen()
-	
+
+	// Create handlers from main config and all files in config directory and run they
+	handlers := startHandlers(*configPath, *configDir)
+
 	// Open socket to excange data with other programs
 	// It`s for web interface 
-	listen, err := net.Listen("unix", "/run/andproxy.sock")
+	listen, err := net.Listen("unix", *socketPath)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -36,24 +42,26 @@ func main() {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals)
 	go func() {
+		stopping := false
 		for {	
 			// For correct handling Ctrl+C and other signals that end program
 			// If not remove andproxy.sock program will not start until file exist
-			// TODO: add different behavior for different signals
 			sig := <-signals
 			switch sig {
-			case syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT:
-				endconn <- struct{}{}
-				os.Remove("/run/andproxy.sock")
-				os.Exit(0)
-			case os.Interrupt:
-				endconn <- struct{}{}
-				os.Remove("/run/andproxy.sock")
-				os.Exit(0)
-			case os.Kill:
-				endconn <- struct{}{}
-				os.Remove("/run/andproxy.sock")
-				os.Exit(0)
+			case syscall.SIGHUP:
+				// reread handler files without dropping live connections
+				handlers.reload()
+			case syscall.SIGTERM, syscall.SIGINT:
+				// second signal end program without waiting active connections
+				if stopping {
+					os.Remove(*socketPath)
+					os.Exit(1)
+				}
+				stopping = true
+				go func() {
+					handlers.shutdown()
+					endconn <- struct{}{}
+				}()
 			default:
 			}
 		}
@@ -72,43 +80,10 @@ func main() {
 	}()
 	
 	// handle socket requests
-	// send current state of all handlers
-	go func() {
-		for {
-			conn, err := listen.Accept()
-			if err != nil {
-				log.Println(err)
-			}
-			command := make([]byte, 100)
-			n, err := conn.Read(command)
-			if err != nil {
-				log.Println(err)
-			}
-			switch string(command[:n]) {
-			case "get current state":
-				// only send current state handler object
-				// all validation on outside
-				data, err := json.Marshal(h)
-				if err != nil {
-					log.Println(err)
-				}
-				_, err = conn.Write(data)
-				if err != nil {
-					log.Println(err)
-				}
-			default:
-
-			}
-			err = conn.Close()
-			if err != nil {
-				log.Println(err)
-			}
-		}
-
-	}()
+	// every line is json command, see internal/control
+	go control.Serve(listen, handlers)
 	// without this program immediately end
-	for {
-
-	}
-	
+	// wait until all handlers are shut down
+	<-endconn
+	os.Remove(*socketPath)
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/averageNetAdmin/andproxy/internal/backend"
+	"github.com/averageNetAdmin/andproxy/internal/client"
+	"github.com/averageNetAdmin/andproxy/internal/config"
+	"github.com/averageNetAdmin/andproxy/internal/handler"
+	"github.com/averageNetAdmin/andproxy/internal/handler/def"
+	myhttp "github.com/averageNetAdmin/andproxy/internal/handler/http"
+	"github.com/averageNetAdmin/andproxy/internal/status"
+)
+
+//	Parse main config and all handler files without binding ports and creating log files
+//	Print summary of handlers to stdout and errors to stderr
+//	Return exit code, it is not zero if any error found
+//
+func check(configPath, dir string) int {
+	global, err := config.Load(configPath)
+	if os.IsNotExist(err) {
+		global, err = nil, nil
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	handlers, errs, err := handler.NewHandlers(dir, global)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		printHandler(os.Stdout, name, handlers[name])
+	}
+
+	names = names[:0]
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, errs[name])
+	}
+
+	if len(errs) != 0 {
+		fmt.Fprintf(os.Stderr, "%d handlers ok, %d with errors\n", len(handlers), len(errs))
+		return 1
+	}
+	if len(handlers) == 0 {
+		fmt.Fprintln(os.Stderr, "no handlers found")
+		return 1
+	}
+	fmt.Printf("%d handlers ok\n", len(handlers))
+	return 0
+}
+
+//	Print what handler listens and where it sends requests
+//
+func printHandler(w io.Writer, name string, h handler.Handler) {
+	switch h := h.(type) {
+	case *def.Handler:
+		c := h.Config()
+		fmt.Fprintf(w, "%s: listen %s 0.0.0.0:%s\n", name, h.Protocol, h.Port)
+		fmt.Fprintf(w, "  log %s, grace period %v\n", c.LogPath, c.GracePeriod)
+		if c.Toport != 0 {
+			fmt.Fprintf(w, "  to port %d\n", c.Toport)
+		}
+		if c.Accept.Len() != 0 {
+			fmt.Fprintf(w, "  accept %s\n", sourcesString(c.Accept))
+		}
+		if c.Deny.Len() != 0 {
+			fmt.Fprintf(w, "  deny %s\n", sourcesString(c.Deny))
+		}
+		printPool(w, "  servers", c.Servers)
+		for i, f := range c.IPFilter {
+			printPool(w, fmt.Sprintf("  ipfilter %d from %s servers", i, sourcesString(f.Source())), f.Servers())
+		}
+	case *myhttp.Handler:
+		c := h.Config()
+		proto := "http"
+		if h.Secure {
+			proto = "https"
+		}
+		fmt.Fprintf(w, "%s: listen %s :%s\n", name, proto, h.Port)
+		fmt.Fprintf(w, "  log %s, grace period %v\n", c.LogPath, c.GracePeriod)
+		for _, site := range c.Sites {
+			cert := ""
+			if site.Certificate != nil && len(site.Certificate.Certificate) != 0 {
+				leaf, err := x509.ParseCertificate(site.Certificate.Certificate[0])
+				if err == nil {
+					cert = fmt.Sprintf(" (certificate %s valid until %s)", leaf.Subject.CommonName, leaf.NotAfter.Format("2006-01-02"))
+				}
+			}
+			fmt.Fprintf(w, "  site %s%s\n", site.DomainName, cert)
+			for _, path := range site.Paths {
+				printPool(w, fmt.Sprintf("    path %s servers", path.Path), path.Servers)
+				for i, f := range path.IPFilter {
+					printPool(w, fmt.Sprintf("    path %s ipfilter %d from %s servers", path.Path, i, sourcesString(f.Source())), f.Servers())
+				}
+			}
+		}
+	default:
+		fmt.Fprintf(w, "%s: %T\n", name, h)
+	}
+}
+
+//	Print balancing, all servers and health check of pool
+//
+func printPool[S backend.Item](w io.Writer, prefix string, p *backend.Pool[S]) {
+	states := serverStates(p.Status(""))
+	srvs := p.Members()
+	addrs := make([]string, len(srvs))
+	for i, srv := range srvs {
+		addrs[i] = serverString(srv.Backend(), states[srv.Address()])
+	}
+	fmt.Fprintf(w, "%s (%s): %s\n", prefix, p.Balancing, strings.Join(addrs, ", "))
+	if p.Checker() != nil {
+		fmt.Fprintf(w, "%s  %v\n", indent(prefix), p.Checker())
+	}
+}
+
+//	Return states of servers of pool by address
+//
+func serverStates(p status.Pool) map[string]string {
+	states := make(map[string]string, len(p.Servers))
+	for _, srv := range p.Servers {
+		states[srv.Addr] = srv.State
+	}
+	return states
+}
+
+//	Return address, weight, priority group and state of server if it does not get connections
+//
+func serverString(srv *backend.Server, state string) string {
+	s := fmt.Sprintf("%s weight %d", srv.Addr, srv.GetWeight())
+	if srv.Priority != 0 {
+		s += fmt.Sprintf(" priority %d", srv.Priority)
+	}
+	if srv.Backup {
+		s += " backup"
+	}
+	if state != status.StateUp {
+		s += " " + state
+	}
+	return s
+}
+
+//	Return leading spaces of s
+//
+func indent(s string) string {
+	return s[:len(s)-len(strings.TrimLeft(s, " "))]
+}
+
+func sourcesString(s *client.Sources) string {
+	return strings.Join(s.Strings(), ", ")
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/averageNetAdmin/andproxy/internal/config"
+	"github.com/averageNetAdmin/andproxy/internal/event"
+	"github.com/averageNetAdmin/andproxy/internal/handler"
+	"github.com/averageNetAdmin/andproxy/internal/status"
+)
+
+//	Running handlers by handler file name
+//
+type handlerSet struct {
+	configPath string
+	dir        string
+	mu         sync.RWMutex
+	m          map[string]handler.Handler
+}
+
+//	Create handlers from all files in directory and from main config and run they
+//	Bad files are skipped, errors are only logged
+//
+func startHandlers(configPath, dir string) *handlerSet {
+	hs := &handlerSet{
+		configPath: configPath,
+		dir:        dir,
+		m:          make(map[string]handler.Handler),
+	}
+	handlers, errs, err := hs.load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, err := range errs {
+		log.Printf("skip handler %s: %v", name, err)
+	}
+	for name, h := range handlers {
+		err := h.Listen()
+		if err != nil {
+			log.Printf("skip handler %s: %v", name, err)
+			continue
+		}
+		hs.m[name] = h
+	}
+	return hs
+}
+
+//	Read main config and create handlers from it and from handler files
+//	Main config is optional, if file does not exist only handler files are used
+//
+func (hs *handlerSet) load() (map[string]handler.Handler, map[string]error, error) {
+	global, err := config.Load(hs.configPath)
+	if os.IsNotExist(err) {
+		global, err = nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return handler.NewHandlers(hs.dir, global)
+}
+
+//	Parse all handler files again and apply changes to running handlers
+//	Handlers with the same file name get new config without rebinding listener,
+//	handlers which files were removed are closed, new handlers start listen
+//	If file can not be parsed, running handler keeps old config
+//	Errors of handlers that keep old config or were not started are returned by name
+//
+func (hs *handlerSet) reload() (map[string]error, error) {
+	fresh, errs, err := hs.load()
+	if err != nil {
+		log.Printf("reload failed: %v", err)
+		event.Publish(event.Event{Type: event.ReloadFailed, Message: err.Error()})
+		return nil, err
+	}
+	for name, err := range errs {
+		log.Printf("reload: keep old config of %s: %v", name, err)
+		event.Publish(event.Event{Type: event.HandlerSkipped, Handler: name, Message: err.Error()})
+	}
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	// close removed handlers first, their ports can be used by new handlers
+	for name, h := range hs.m {
+		if _, ok := fresh[name]; ok {
+			continue
+		}
+		if _, ok := errs[name]; ok {
+			continue
+		}
+		err := h.Close()
+		if err != nil {
+			log.Printf("reload: close handler %s: %v", name, err)
+		}
+		delete(hs.m, name)
+		log.Printf("reload: handler %s removed", name)
+		event.Publish(event.Event{Type: event.HandlerRemoved, Handler: name})
+	}
+
+	for name, n := range fresh {
+		running, ok := hs.m[name]
+		if ok {
+			err := handler.Reload(running, n)
+			if err == nil {
+				log.Printf("reload: handler %s updated", name)
+				event.Publish(event.Event{Type: event.HandlerUpdated, Handler: name})
+				continue
+			}
+			// handler can not be updated in place, so it must be rebound
+			log.Printf("reload: restart handler %s: %v", name, err)
+			err = running.Close()
+			if err != nil {
+				log.Printf("reload: close handler %s: %v", name, err)
+			}
+			delete(hs.m, name)
+		}
+		err := n.Listen()
+		if err != nil {
+			log.Printf("reload: skip handler %s: %v", name, err)
+			event.Publish(event.Event{Type: event.HandlerSkipped, Handler: name, Message: err.Error()})
+			errs[name] = err
+			continue
+		}
+		hs.m[name] = n
+		log.Printf("reload: handler %s started", name)
+		event.Publish(event.Event{Type: event.HandlerStarted, Handler: name})
+	}
+	event.Publish(event.Event{Type: event.ReloadCompleted})
+	return errs, nil
+}
+
+//	Implement control.Backend
+//
+func (hs *handlerSet) Reload() (map[string]error, error) {
+	return hs.reload()
+}
+
+//	Status of all running handlers sorted by name
+//
+func (hs *handlerSet) Handlers() []status.Handler {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	names := make([]string, 0, len(hs.m))
+	for name := range hs.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]status.Handler, 0, len(names))
+	for _, name := range names {
+		st := hs.m[name].Status()
+		st.Name = name
+		res = append(res, st)
+	}
+	return res
+}
+
+//	Enable or disable server in handler with name, in all handlers if name is empty
+//	Return error if no server with address addr found
+//
+func (hs *handlerSet) SetServerEnabled(name, addr string, enabled bool) (int, error) {
+	typ := event.ServerDisabled
+	if enabled {
+		typ = event.ServerEnabled
+	}
+	return hs.changeServer(name, addr, event.Event{Type: typ}, func(h handler.Handler) (int, error) {
+		return h.SetServerEnabled(addr, enabled), nil
+	})
+}
+
+//	Put server in maintenance in handler with name, in all handlers if name is empty
+//	Return error if no server with address addr found
+//
+func (hs *handlerSet) SetServerMaintenance(name, addr string) (int, error) {
+	return hs.changeServer(name, addr, event.Event{Type: event.ServerMaint}, func(h handler.Handler) (int, error) {
+		return h.SetServerMaintenance(addr), nil
+	})
+}
+
+//	Set weight of server in handler with name, in all handlers if name is empty
+//	Return error if no server with address addr found
+//
+func (hs *handlerSet) SetServerWeight(name, addr string, weight int) (int, error) {
+	e := event.Event{Type: event.ServerChanged, Message: fmt.Sprintf("weight %d", weight)}
+	return hs.changeServer(name, addr, e, func(h handler.Handler) (int, error) {
+		return h.SetServerWeight(addr, weight), nil
+	})
+}
+
+//	Add server to pool of handler with name
+//
+func (hs *handlerSet) AddServer(name, pool, addr string, weight int) (int, error) {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	h, ok := hs.m[name]
+	if !ok {
+		return 0, fmt.Errorf("handler %s not found", name)
+	}
+	return h.AddServer(pool, config.Server{Addr: addr, Weight: weight})
+}
+
+//	Remove server from pool of handler with name, from all pools and handlers if they are empty
+//	Return error if no server with address addr found
+//
+func (hs *handlerSet) RemoveServer(name, pool, addr string) (int, error) {
+	// pool publishes removed servers
+	return hs.changeServer(name, addr, event.Event{}, func(h handler.Handler) (int, error) {
+		return h.RemoveServer(pool, addr)
+	})
+}
+
+//	Call change for handler with name, for all handlers if name is empty
+//	Event e is published for every handler where servers were changed, if it has type
+//	Return number of changed servers, error if no server with address addr found
+//
+func (hs *handlerSet) changeServer(name, addr string, e event.Event, change func(h handler.Handler) (int, error)) (int, error) {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	if name != "" {
+		if _, ok := hs.m[name]; !ok {
+			return 0, fmt.Errorf("handler %s not found", name)
+		}
+	}
+	found := false
+	n := 0
+	for hname, h := range hs.m {
+		if name != "" && hname != name {
+			continue
+		}
+		found = found || hasServer(h.Status(), addr)
+		changed, err := change(h)
+		if err != nil {
+			return n, fmt.Errorf("%s: %v", hname, err)
+		}
+		if changed != 0 && e.Type != "" {
+			e.Handler = hname
+			e.Server = addr
+			event.Publish(e)
+		}
+		n += changed
+		if changed != 0 {
+			found = true
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("server %s not found", addr)
+	}
+	return n, nil
+}
+
+//	Add addresses to accept or deny list of handler or remove they from list
+//
+func (hs *handlerSet) UpdateSources(name, list string, addrs []string, remove bool) error {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	h, ok := hs.m[name]
+	if !ok {
+		return fmt.Errorf("handler %s not found", name)
+	}
+	err := h.UpdateSources(list, addrs, remove)
+	if err != nil {
+		return err
+	}
+	action := "added to"
+	if remove {
+		action = "removed from"
+	}
+	event.Publish(event.Event{
+		Type:    event.SourcesChanged,
+		Handler: name,
+		Message: fmt.Sprintf("%s %s %s", strings.Join(addrs, ", "), action, list),
+	})
+	return nil
+}
+
+func hasServer(st status.Handler, addr string) bool {
+	for _, srv := range st.Servers() {
+		if srv.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+//	Shut down all handlers at the same time
+//	Every handler waits its active connections not longer than its grace period
+//
+func (hs *handlerSet) shutdown() {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	wg := new(sync.WaitGroup)
+	for name, h := range hs.m {
+		wg.Add(1)
+		go func(name string, h handler.Handler) {
+			err := h.Shutdown(context.Background())
+			if err != nil {
+				log.Printf("shutdown handler %s: %v", name, err)
+			}
+			wg.Done()
+		}(name, h)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/averageNetAdmin/andproxy/internal/control"
+	"github.com/averageNetAdmin/andproxy/internal/event"
+	"github.com/averageNetAdmin/andproxy/internal/status"
+)
+
+const usage = `Usage: andproxyctl [-socket path] <command> [arguments]
+
+Commands:
+  status [-json] [handler]                  handlers, sites, paths and servers
+  servers [-json] [handler]                 servers of all handlers or of one handler
+  enable [-handler name] <server>           send new connections to server again
+  disable [-handler name] <server>          stop sending new connections to server
+  drain [-handler name] [-timeout d] <server>
+                                            disable server and wait until its connections end
+  maintenance [-handler name] <server>      no new connections and no health checks until enabled
+  weight [-handler name] <server> <weight>  change weight of server
+  add -handler name [-pool name] [-weight n] <server>
+                                            add server to pool, pool is required if handler has many
+  remove [-handler name] [-pool name] <server>
+                                            remove server, its connections are drained
+  accept add|remove <handler> <address>...  change accept list of handler
+  deny add|remove <handler> <address>...    change deny list of handler
+  reload                                    reread configs like on SIGHUP
+  events [-json]                            print events until interrupted
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	socketPath := flag.String("socket", control.SocketPath, "control socket")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	switch cmd {
+	case "status", "servers", "enable", "disable", "drain", "maintenance", "weight", "add", "remove",
+		"accept", "deny", "reload", "events":
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client, err := control.Dial(*socketPath)
+	if err != nil {
+		fatal(err)
+	}
+	defer client.Close()
+
+	switch cmd {
+	case "status", "servers":
+		err = statusCmd(client, cmd, args)
+	case "enable", "disable", "drain", "maintenance", "weight", "add", "remove":
+		err = serverCmd(client, cmd, args)
+	case "accept", "deny":
+		err = sourcesCmd(client, cmd, args)
+	case "reload":
+		err = reloadCmd(client)
+	case "events":
+		err = eventsCmd(client, args)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "andproxyctl: %v\n", err)
+	os.Exit(1)
+}
+
+//	Print status of handlers or servers as tables or json
+//
+func statusCmd(client *control.Client, cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print json")
+	fs.Parse(args)
+	req := control.Request{Command: control.CmdHandlers, Handler: fs.Arg(0)}
+	if cmd == "servers" {
+		req.Command = control.CmdServers
+		var srvs []status.Server
+		err := client.Do(req, &srvs)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(srvs)
+		}
+		printServers(os.Stdout, srvs)
+		return nil
+	}
+	var hs []status.Handler
+	err := client.Do(req, &hs)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(hs)
+	}
+	printStatus(os.Stdout, hs)
+	return nil
+}
+
+//	Change server: enable, disable, drain, put in maintenance, change weight, add or remove
+//	Drain disables server and waits until it has no active connections
+//
+func serverCmd(client *control.Client, cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	handler := fs.String("handler", "", "handler name, all handlers if not set")
+	timeout := fs.Duration("timeout", 5*time.Minute, "max time to wait connections on drain")
+	pool := fs.String("pool", "", "pool name as shown by servers command, all pools on remove if not set")
+	weight := fs.Int("weight", 0, "weight of added server")
+	fs.Parse(args)
+	nargs := 1
+	if cmd == "weight" {
+		nargs = 2
+	}
+	if fs.NArg() != nargs {
+		return fmt.Errorf("%s: server address required", cmd)
+	}
+	addr := fs.Arg(0)
+	req := control.Request{Handler: *handler, Pool: *pool, Server: addr}
+	switch cmd {
+	case "enable":
+		req.Command = control.CmdEnable
+	case "disable":
+		req.Command = control.CmdDisable
+	case "drain":
+		req.Command = control.CmdDrain
+	case "maintenance":
+		req.Command = control.CmdMaintenance
+	case "weight":
+		req.Command = control.CmdWeight
+		w, err := strconv.Atoi(fs.Arg(1))
+		if err != nil {
+			return fmt.Errorf("weight: invalid weight %s", fs.Arg(1))
+		}
+		req.Weight = w
+	case "add":
+		req.Command = control.CmdAddServer
+		req.Weight = *weight
+	case "remove":
+		req.Command = control.CmdRemoveServer
+	}
+	var res control.ServerResult
+	err := client.Do(req, &res)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d servers changed, %d active connections\n", addr, res.Changed, res.Active)
+	if cmd != "drain" {
+		return nil
+	}
+
+	deadline := time.Now().Add(*timeout)
+	active := res.Active
+	for active != 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: %d connections still active after %v", addr, active, *timeout)
+		}
+		time.Sleep(time.Second)
+		var srvs []status.Server
+		err := client.Do(control.Request{Command: control.CmdServers, Handler: *handler}, &srvs)
+		if err != nil {
+			return err
+		}
+		active = 0
+		for _, srv := range srvs {
+			if srv.Addr == addr {
+				active += srv.Active
+			}
+		}
+		fmt.Printf("%s: %d active connections\n", addr, active)
+	}
+	fmt.Printf("%s: drained\n", addr)
+	return nil
+}
+
+//	Add addresses to accept or deny list or remove they from list
+//
+func sourcesCmd(client *control.Client, list string, args []string) error {
+	if len(args) < 3 || (args[0] != "add" && args[0] != "remove") {
+		return fmt.Errorf("usage: %s add|remove <handler> <address>...", list)
+	}
+	req := control.Request{
+		Command: control.CmdAddSources,
+		Handler: args[1],
+		List:    list,
+		Addrs:   args[2:],
+	}
+	if args[0] == "remove" {
+		req.Command = control.CmdRemoveSources
+	}
+	return client.Do(req, nil)
+}
+
+//	Reload configs and print handlers that keep old config
+//
+func reloadCmd(client *control.Client) error {
+	var res control.ReloadResult
+	err := client.Do(control.Request{Command: control.CmdReload}, &res)
+	if err != nil {
+		return err
+	}
+	if len(res.Errors) == 0 {
+		fmt.Println("reloaded")
+		return nil
+	}
+	for name, msg := range res.Errors {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, msg)
+	}
+	return fmt.Errorf("%d handlers not reloaded", len(res.Errors))
+}
+
+//	Print events until connection is closed
+//
+func eventsCmd(client *control.Client, args []string) error {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print json")
+	fs.Parse(args)
+	return client.Events(func(e event.Event) error {
+		if *asJSON {
+			return printJSON(e)
+		}
+		printEvent(os.Stdout, e)
+		return nil
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/averageNetAdmin/andproxy/internal/event"
+	"github.com/averageNetAdmin/andproxy/internal/status"
+)
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+//	Print table of handlers, table of http paths and table of servers
+//
+func printStatus(w io.Writer, hs []status.Handler) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HANDLER\tPROTOCOL\tPORT\tCONNECTIONS\tACTIVE\tREJECTED\tACCEPT\tDENY")
+	for _, h := range hs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n", h.Name, h.Protocol, h.Port,
+			h.Connections, h.Active, h.Rejected, list(h.Accept), list(h.Deny))
+	}
+	tw.Flush()
+
+	paths := false
+	for _, h := range hs {
+		paths = paths || len(h.Sites) != 0
+	}
+	if paths {
+		fmt.Fprintln(w)
+		fmt.Fprintln(tw, "HANDLER\tSITE\tPATH\tCONNECTIONS\tACTIVE\tREJECTED\tACCEPT\tDENY")
+		for _, h := range hs {
+			for _, site := range h.Sites {
+				for _, p := range site.Paths {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n", h.Name, site.Domain, p.Path,
+						p.Connections, p.Active, p.Rejected, list(p.Accept), list(p.Deny))
+				}
+			}
+		}
+		tw.Flush()
+	}
+
+	srvs := make([]status.Server, 0)
+	for i := range hs {
+		srvs = append(srvs, hs[i].Servers()...)
+	}
+	fmt.Fprintln(w)
+	printServers(w, srvs)
+}
+
+//	Print table of servers
+//
+func printServers(w io.Writer, srvs []status.Server) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HANDLER\tPOOL\tSERVER\tWEIGHT\tSTATE\tCONNECTIONS\tACTIVE\tFAILS")
+	for _, srv := range srvs {
+		// weight of server in slow start is shown as effective/configured
+		weight := fmt.Sprint(srv.Weight)
+		if srv.Effective != srv.Weight {
+			weight = fmt.Sprintf("%d/%d", srv.Effective, srv.Weight)
+		}
+		addr := srv.Addr
+		if srv.Host != "" {
+			addr += " (" + srv.Host + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n", srv.Handler, srv.Pool, addr,
+			weight, srv.State, srv.Connections, srv.Active, srv.Fails)
+	}
+	tw.Flush()
+}
+
+func printEvent(w io.Writer, e event.Event) {
+	parts := []string{e.Time.Format("2006-01-02 15:04:05"), e.Type}
+	if e.Handler != "" {
+		parts = append(parts, "handler="+e.Handler)
+	}
+	if e.Server != "" {
+		parts = append(parts, "server="+e.Server)
+	}
+	if e.Message != "" {
+		parts = append(parts, e.Message)
+	}
+	fmt.Fprintln(w, strings.Join(parts, " "))
+}
+
+func list(addrs []string) string {
+	if len(addrs) == 0 {
+		return "-"
+	}
+	return strings.Join(addrs, ",")
+}
@@ -1,27 +1,42 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
+
+	"github.com/averageNetAdmin/andproxy/internal/control"
 )
 
 type handler struct {
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	conn, err := net.Dial("unix", "/run/andproxy.sock")
+	conn, err := net.Dial("unix", control.SocketPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	err = json.NewEncoder(conn).Encode(control.Request{Version: control.Version, Command: control.CmdHandlers})
 	if err != nil {
-		log.Fatal(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
 	}
-	conn.Write([]byte("get current state"))
-	data := make([]byte, 5000)
-	n, err := conn.Read(data)
+	var resp control.Response
+	err = json.NewDecoder(bufio.NewReader(conn)).Decode(&resp)
 	if err != nil {
-		log.Fatal(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if !resp.OK {
+		http.Error(w, resp.Error, http.StatusBadGateway)
+		return
 	}
-	fmt.Fprint(w, string(data[:n]))
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(resp.Data))
 }
 
 func main() {
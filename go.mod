@@ -3,6 +3,6 @@ module github.com/averageNetAdmin/andproxy
 go 1.18
 
 require (
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20220512140231-539c8e751b99 // indirect
+	github.com/mitchellh/mapstructure v1.5.0
+	gopkg.in/yaml.v3 v3.0.0-20220512140231-539c8e751b99
 )
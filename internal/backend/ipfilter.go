@@ -1,4 +1,4 @@
-package def
+package backend
 
 import (
 	"github.com/averageNetAdmin/andproxy/internal/client"
@@ -6,16 +6,16 @@ import (
 
 //	Compare servers ip addresses with source addresses
 //
-type IPFilter struct {
+type IPFilter[S Item] struct {
 	source  *client.Sources
-	servers *Pool
+	servers *Pool[S]
 }
 
 //	Check is ip address in struct
 //	Return true if struct contains searchIP ip address else return false
 //	If searchIP is not valid ip address return false
 //
-func (f *IPFilter) Contains(ip string) *Pool {
+func (f *IPFilter[S]) Contains(ip string) *Pool[S] {
 	content := f.source.Contains(ip)
 	if content {
 		return f.servers
@@ -25,9 +25,21 @@ func (f *IPFilter) Contains(ip string) *Pool {
 
 // Createt new Filter from servers Pool and Sources
 //
-func NewFilter(pool *Pool, from *client.Sources) *IPFilter {
-	return &IPFilter{
+func NewFilter[S Item](pool *Pool[S], from *client.Sources) *IPFilter[S] {
+	return &IPFilter[S]{
 		servers: pool,
 		source:  from,
 	}
 }
+
+//	Return source addresses of filter
+//
+func (f *IPFilter[S]) Source() *client.Sources {
+	return f.source
+}
+
+//	Return servers of filter
+//
+func (f *IPFilter[S]) Servers() *Pool[S] {
+	return f.servers
+}
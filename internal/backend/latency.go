@@ -0,0 +1,61 @@
+package backend
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time in which old latency of server loses most of its weight in average
+//
+const latencyDecay = 10 * time.Second
+
+// Peak exponentially weighted moving average of server latency
+// Slower response replaces average at once, faster responses lower it smoothly
+//
+type latency struct {
+	// average in nanoseconds, 0 if nothing is observed yet
+	average int64
+	// unix time in nanoseconds of last observation
+	last int64
+	// orders observations, average is read without it
+	mu sync.Mutex
+}
+
+//	Add connect time or time to first byte of response to latency of server
+//
+func (s *Server) Observe(d time.Duration) {
+	l := &s.latency
+	now := time.Now().UnixNano()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	average := atomic.LoadInt64(&l.average)
+	last := atomic.LoadInt64(&l.last)
+	if int64(d) > decay(average, last, now) {
+		average = int64(d)
+	} else {
+		w := math.Exp(-float64(now-last) / float64(latencyDecay))
+		average = int64(float64(average)*w + float64(d)*(1-w))
+	}
+	atomic.StoreInt64(&l.average, average)
+	atomic.StoreInt64(&l.last, now)
+}
+
+//	Return peak moving average of server latency, 0 if nothing is observed yet
+//	Average decays while server gets no requests, so slow server is tried again later
+//	Getter to match BalanceItem interface
+//
+func (s *Server) Latency() time.Duration {
+	l := &s.latency
+	return time.Duration(decay(atomic.LoadInt64(&l.average), atomic.LoadInt64(&l.last), time.Now().UnixNano()))
+}
+
+//	Return average that was observed at last, decayed to now
+//
+func decay(average, last, now int64) int64 {
+	if average == 0 || now <= last {
+		return average
+	}
+	return int64(float64(average) * math.Exp(-float64(now-last)/float64(latencyDecay)))
+}
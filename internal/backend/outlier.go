@@ -0,0 +1,193 @@
+package backend
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/averageNetAdmin/andproxy/internal/config"
+	"github.com/averageNetAdmin/andproxy/internal/event"
+)
+
+// Values used if they are not set in outlier detection config
+//
+const (
+	DefaultConsecutiveErrors  = 5
+	DefaultMinRequests        = 5
+	DefaultOutlierInterval    = 10 * time.Second
+	DefaultEjectionTime       = 30 * time.Second
+	DefaultMaxEjectionTime    = 300 * time.Second
+	DefaultMaxEjectionPercent = 10
+)
+
+// Results of connections and requests to server that are used to find outliers
+//
+type outlierStats struct {
+	// connections and failed connections since last detection interval
+	requests int64
+	errors   int64
+	// failed connections in a row
+	consecutive int64
+	// unix time in nanoseconds when ejection ends, 0 if server is not ejected
+	ejectedUntil int64
+	// ejections in a row, ejection time is doubled with every ejection
+	// guarded by lock of pool
+	ejections int
+}
+
+//	Return true if server is ejected from pool by outlier detection
+//
+func (s *Server) Ejected() bool {
+	return atomic.LoadInt64(&s.outlier.ejectedUntil) != 0
+}
+
+//	Detect outliers among servers of pool by results that are reported by handler
+//	Detection begins when pool is started, not set values are replaced by defaults
+//
+func (p *Pool[S]) SetOutlierDetection(c *config.OutlierDetection) {
+	o := *c
+	if o.ConsecutiveErrors == 0 {
+		o.ConsecutiveErrors = DefaultConsecutiveErrors
+	}
+	if o.MinRequests == 0 {
+		o.MinRequests = DefaultMinRequests
+	}
+	if o.Interval == 0 {
+		o.Interval = DefaultOutlierInterval
+	}
+	if o.EjectionTime == 0 {
+		o.EjectionTime = DefaultEjectionTime
+	}
+	if o.MaxEjectionTime == 0 {
+		o.MaxEjectionTime = DefaultMaxEjectionTime
+	}
+	if o.MaxEjectionTime < o.EjectionTime {
+		o.MaxEjectionTime = o.EjectionTime
+	}
+	if o.MaxEjectionPercent == 0 {
+		o.MaxEjectionPercent = DefaultMaxEjectionPercent
+	}
+	p.outlier = &o
+}
+
+//	Report result of connection or request to server of pool
+//	Server is ejected at once when it fails ConsecutiveErrors times in a row
+//
+func (p *Pool[S]) Report(srv S, failed bool) {
+	o := p.outlier
+	if o == nil {
+		return
+	}
+	st := &srv.Backend().outlier
+	atomic.AddInt64(&st.requests, 1)
+	if !failed {
+		atomic.StoreInt64(&st.consecutive, 0)
+		return
+	}
+	atomic.AddInt64(&st.errors, 1)
+	if atomic.AddInt64(&st.consecutive, 1) < int64(o.ConsecutiveErrors) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.eject(srv, fmt.Sprintf("%d errors in a row", o.ConsecutiveErrors), time.Now()) {
+		p.update()
+	}
+}
+
+//	Eject server from pool for time that grows with every ejection in a row
+//	Server is not ejected if it would make more than MaxEjectionPercent percent of servers ejected,
+//	but one server of pool can always be ejected if pool has other servers
+//	Return true if server is ejected, pool must be updated after that
+//	Must be called with lock held
+//
+func (p *Pool[S]) eject(srv S, reason string, now time.Time) bool {
+	st := &srv.Backend().outlier
+	if srv.Backend().Ejected() {
+		return false
+	}
+	member := false
+	ejected := 0
+	for _, m := range p.members {
+		if m == srv {
+			member = true
+		}
+		if m.Backend().Ejected() {
+			ejected++
+		}
+	}
+	// removed servers are not in balancing anyway
+	if !member {
+		return false
+	}
+	if ejected+1 >= len(p.members) || (ejected > 0 && (ejected+1)*100 > p.outlier.MaxEjectionPercent*len(p.members)) {
+		return false
+	}
+	st.ejections++
+	ejection := p.outlier.EjectionTime
+	for i := 1; i < st.ejections && ejection < p.outlier.MaxEjectionTime; i++ {
+		ejection *= 2
+	}
+	if ejection > p.outlier.MaxEjectionTime {
+		ejection = p.outlier.MaxEjectionTime
+	}
+	atomic.StoreInt64(&st.consecutive, 0)
+	atomic.StoreInt64(&st.ejectedUntil, now.Add(ejection).UnixNano())
+	event.Publish(event.Event{
+		Type:    event.ServerEjected,
+		Server:  srv.Address(),
+		Message: fmt.Sprintf("%s, ejected for %v", reason, ejection),
+	})
+	return true
+}
+
+//	Detect outliers every interval until pool is stopped
+//
+func (p *Pool[S]) watchOutliers() {
+	ticker := time.NewTicker(p.outlier.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		p.detectOutliers(time.Now())
+	}
+}
+
+//	Return servers which ejection time is over to pool and eject servers
+//	which error rate in last interval is ErrorRate or higher
+//	Server that is not ejected for interval is forgiven one ejection
+//
+func (p *Pool[S]) detectOutliers(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := false
+	for _, srv := range p.members {
+		st := &srv.Backend().outlier
+		requests := atomic.SwapInt64(&st.requests, 0)
+		errors := atomic.SwapInt64(&st.errors, 0)
+		if until := atomic.LoadInt64(&st.ejectedUntil); until != 0 {
+			if now.UnixNano() >= until {
+				atomic.StoreInt64(&st.ejectedUntil, 0)
+				event.Publish(event.Event{Type: event.ServerReturned, Server: srv.Address()})
+				changed = true
+			}
+			continue
+		}
+		if p.outlier.ErrorRate > 0 && requests >= int64(p.outlier.MinRequests) &&
+			errors*100 >= int64(p.outlier.ErrorRate)*requests {
+			if p.eject(srv, fmt.Sprintf("%d of %d requests failed", errors, requests), now) {
+				changed = true
+				continue
+			}
+		}
+		if st.ejections > 0 {
+			st.ejections--
+		}
+	}
+	if changed {
+		p.update()
+	}
+}
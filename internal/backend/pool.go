@@ -0,0 +1,774 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/averageNetAdmin/andproxy/internal/balancing"
+	"github.com/averageNetAdmin/andproxy/internal/config"
+	"github.com/averageNetAdmin/andproxy/internal/dns"
+	"github.com/averageNetAdmin/andproxy/internal/event"
+	"github.com/averageNetAdmin/andproxy/internal/health"
+	"github.com/averageNetAdmin/andproxy/internal/status"
+)
+
+// How often weights of warming servers are updated
+//
+const slowStartStep = time.Second
+
+// Server of handler that is balanced by pool
+// Handlers embed *Server in their servers, so Backend is promoted from it
+//
+type Item interface {
+	comparable
+	balancing.BalanceItem
+	Backend() *Server
+}
+
+// Operate with servers
+// Handlers create pool of their servers, wrap makes handler server from new server of pool
+//
+type Pool[S Item] struct {
+	Servers []S
+	// servers that are up but are not used because group with higher priority is used
+	Standby []S
+	Broken  []S
+	// servers that are removed from pool but still have active connections
+	Draining []S
+	// priority group is used if it has at least MinServers servers up
+	MinServers int
+	Balancing  string
+	// all servers of pool, servers of host names and servers file are added to the end
+	members   []S
+	balancing balancing.Method
+	wrap      func(*Server) S
+	// nil if servers are not checked
+	checker *health.Checker
+	// servers file that is read again until pool is stopped, nil if not set
+	file *serversFile[S]
+	// nil if outliers are not detected
+	outlier *config.OutlierDetection
+	// servers of host names that are resolved again until pool is stopped
+	hosts []*host[S]
+	stop  chan struct{}
+	start sync.Once
+	close sync.Once
+	// unix times in nanoseconds when slow start of last server ends and when
+	// servers were rebalanced last time, weights of warming servers change over time
+	warmUntil     int64
+	lastRebalance int64
+	// servers that are used for balancing, replaced on every update
+	// and read by FindServer without lock
+	snap atomic.Value
+	// protects Servers, Standby, Broken, Draining and members,
+	// writers hold it while they build new snapshot
+	mu sync.RWMutex
+}
+
+// Servers of pool that are used for balancing
+// Snapshot is never changed after it is stored, so it can be read without lock
+//
+type snapshot[S Item] struct {
+	servers []S
+	// same servers as BalanceItem, because []*Server can't be passed as []BalanceItem
+	items []balancing.BalanceItem
+}
+
+// Servers of one host name from config by address
+//
+type host[S Item] struct {
+	conf    config.Server
+	servers map[string]S
+}
+
+// Servers of servers file with they config by address
+//
+type serversFile[S Item] struct {
+	path     string
+	interval time.Duration
+	// last content of file, changes are applied only if content is changed
+	data    []byte
+	servers map[string]S
+	confs   map[string]config.Server
+}
+
+// Create new Pool
+//
+func NewPool[S Item](servers []S, balancingMethod string, wrap func(*Server) S) (*Pool[S], error) {
+
+	var bm balancing.Method
+	broken := make([]S, 0)
+	var err error
+	if balancingMethod == "" {
+		balancingMethod = "roundrobin"
+	}
+	bm, err = balancing.NewMethod(balancingMethod)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pool[S]{
+		Servers:   servers,
+		Broken:    broken,
+		members:   servers,
+		Balancing: balancingMethod,
+		balancing: bm,
+		wrap:      wrap,
+		stop:      make(chan struct{}),
+	}
+	// choose priority group and rebalance
+	p.UpdateBroken()
+	return p, nil
+}
+
+// Create new Pool from servers config
+// If check is not nil servers are checked on port, if port is not set in check
+// Priority group is used if at least minServers its servers are up
+//
+func PoolFromConfig[S Item](servers []config.Server, balancingMethod string, minServers int, check *config.HealthCheck, port int,
+	wrap func(*Server) S) (*Pool[S], error) {
+	srvs := make([]S, 0)
+	hosts := make([]*host[S], 0)
+	for _, c := range servers {
+		srvss, err := ServersFromConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		h := &host[S]{conf: c, servers: make(map[string]S, len(srvss))}
+		for _, base := range srvss {
+			srv := wrap(base)
+			h.servers[base.Addr] = srv
+			srvs = append(srvs, srv)
+		}
+		if dns.IsHostname(c.Addr) {
+			hosts = append(hosts, h)
+		}
+	}
+	pool, err := NewPool(srvs, balancingMethod, wrap)
+	if err != nil {
+		return nil, err
+	}
+	pool.hosts = hosts
+	if minServers > 1 {
+		pool.MinServers = minServers
+		pool.UpdateBroken()
+	}
+	if check != nil {
+		pool.checker, err = health.NewChecker(check, port)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+//	Check servers of pool, resolve host names of servers, read servers file and detect outliers until Stop is called
+//	Pool is updated when health of servers, addresses of host names or servers file are changed
+//
+func (p *Pool[S]) Start() {
+	p.start.Do(func() {
+		if p.checker != nil {
+			p.checker.Start(p.targets, p.UpdateBroken)
+		}
+		for _, h := range p.hosts {
+			go p.watchHost(h)
+		}
+		if p.file != nil {
+			go p.watchFile(p.file)
+		}
+		if p.outlier != nil {
+			go p.watchOutliers()
+		}
+	})
+}
+
+//	Return health checker of pool, nil if servers are not checked
+//
+func (p *Pool[S]) Checker() *health.Checker {
+	return p.checker
+}
+
+//	Stop health checks, resolving of host names, reading of servers file and outlier detection
+//
+func (p *Pool[S]) Stop() {
+	p.close.Do(func() {
+		close(p.stop)
+		if p.checker != nil {
+			p.checker.Stop()
+		}
+	})
+}
+
+//	Resolve host name every interval and update servers of host until pool is stopped
+//	If host name is not resolved servers of old addresses are kept
+//
+func (p *Pool[S]) watchHost(h *host[S]) {
+	interval := h.conf.ResolveInterval
+	if interval == 0 {
+		interval = dns.DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		p.resolveHost(h)
+	}
+}
+
+//	Resolve host name with default resolver and update servers of host
+//	Servers are not changed if host name is not resolved
+//
+func (p *Pool[S]) resolveHost(h *host[S]) {
+	addrs, err := dns.LookupDefault(h.conf.Addr)
+	if err != nil {
+		event.Publish(event.Event{Type: event.ResolveFailed, Server: h.conf.Addr, Message: err.Error()})
+		return
+	}
+	p.setHostAddrs(h, addrs)
+}
+
+//	Create servers for new addresses of host and remove servers of addresses that host has no more
+//
+func (p *Pool[S]) setHostAddrs(h *host[S], addrs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := false
+	resolved := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		resolved[addr] = true
+		if _, ok := h.servers[addr]; ok {
+			continue
+		}
+		base, err := serverFromConfig(h.conf, addr)
+		if err != nil {
+			event.Publish(event.Event{Type: event.ResolveFailed, Server: h.conf.Addr, Message: err.Error()})
+			continue
+		}
+		srv := p.wrap(base)
+		h.servers[addr] = srv
+		p.addServer(srv, h.conf.Addr)
+		changed = true
+	}
+	for addr, srv := range h.servers {
+		if resolved[addr] {
+			continue
+		}
+		delete(h.servers, addr)
+		p.removeServer(srv, h.conf.Addr)
+		changed = true
+	}
+	if changed {
+		p.update()
+	}
+}
+
+//	Read servers from file and apply they to pool if file is changed
+//	Servers are added to pool when servers file is set, they are started and stopped with pool
+//	interval is config.DefaultServersFileInterval if it is 0
+//
+func (p *Pool[S]) SetServersFile(path string, interval time.Duration) error {
+	if interval == 0 {
+		interval = config.DefaultServersFileInterval
+	}
+	f := &serversFile[S]{
+		path:     path,
+		interval: interval,
+		servers:  make(map[string]S),
+		confs:    make(map[string]config.Server),
+	}
+	err := p.readServersFile(f)
+	if err != nil {
+		return err
+	}
+	p.file = f
+	return nil
+}
+
+//	Read servers file every interval until pool is stopped
+//	If file can not be read or has errors pool is not changed
+//
+func (p *Pool[S]) watchFile(f *serversFile[S]) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		err := p.readServersFile(f)
+		if err != nil {
+			event.Publish(event.Event{Type: event.ServersFailed, Message: err.Error()})
+		}
+	}
+}
+
+func (p *Pool[S]) readServersFile(f *serversFile[S]) error {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	if f.data != nil && bytes.Equal(data, f.data) {
+		return nil
+	}
+	confs, err := config.ParseServers(f.path, data)
+	if err != nil {
+		// file with errors is reported once
+		f.data = data
+		return err
+	}
+	// range or host name in file is one server for every address
+	byAddr := make(map[string]config.Server, len(confs))
+	for _, c := range confs {
+		addrs, err := dns.Addrs(c.Addr)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", f.path, c.Addr, err)
+		}
+		for _, addr := range addrs {
+			byAddr[addr] = c
+		}
+	}
+	p.setFileServers(f, byAddr)
+	f.data = data
+	return nil
+}
+
+//	Add servers that are new in file, change servers with changed config and remove servers
+//	that are not in file anymore
+//	Server is replaced by new one if its settings used by connections are changed
+//
+func (p *Pool[S]) setFileServers(f *serversFile[S], confs map[string]config.Server) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addrs := make([]string, 0, len(confs))
+	for addr := range confs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		c := confs[addr]
+		if srv, ok := f.servers[addr]; ok {
+			if f.confs[addr] == c {
+				continue
+			}
+			if srv.Backend().reconfigure(f.confs[addr], c) {
+				f.confs[addr] = c
+				event.Publish(event.Event{Type: event.ServerChanged, Server: addr, Message: f.path})
+				continue
+			}
+			delete(f.servers, addr)
+			delete(f.confs, addr)
+			p.removeServer(srv, f.path)
+		}
+		base, err := serverFromConfig(c, addr)
+		if err != nil {
+			event.Publish(event.Event{Type: event.ServersFailed, Server: addr, Message: err.Error()})
+			continue
+		}
+		srv := p.wrap(base)
+		f.servers[addr] = srv
+		f.confs[addr] = c
+		p.addServer(srv, f.path)
+	}
+	for addr, srv := range f.servers {
+		if _, ok := confs[addr]; ok {
+			continue
+		}
+		delete(f.servers, addr)
+		delete(f.confs, addr)
+		p.removeServer(srv, f.path)
+	}
+	p.update()
+}
+
+//	Add server to pool, source is host name or file where server is found
+//	Must be called with lock held, pool must be updated after
+//
+func (p *Pool[S]) addServer(srv S, source string) {
+	p.members = append(p.members, srv)
+	event.Publish(event.Event{Type: event.ServerAdded, Server: srv.Address(), Message: source})
+}
+
+//	Remove server from pool, it gets no new connections and is kept in Draining until its connections end
+//	Must be called with lock held, pool must be updated after
+//
+func (p *Pool[S]) removeServer(srv S, source string) {
+	members := make([]S, 0, len(p.members))
+	for _, member := range p.members {
+		if member != srv {
+			members = append(members, member)
+		}
+	}
+	p.members = members
+	p.Draining = append(p.Draining, srv)
+	event.Publish(event.Event{Type: event.ServerRemoved, Server: srv.Address(), Message: source})
+}
+
+//	Return servers of pool that are checked, all servers including standby and broken except servers in maintenance
+//
+func (p *Pool[S]) targets() []health.Target {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	srvs := p.all()
+	targets := make([]health.Target, 0, len(srvs))
+	for _, srv := range srvs {
+		// server in maintenance is expected to be down
+		if !srv.Backend().InMaintenance() {
+			targets = append(targets, srv.Backend())
+		}
+	}
+	return targets
+}
+
+//	Check that servers are disabled, unhealthy or ejected and move they from Servers pool to Broken
+//	Servers that are up again are moved back
+//	Only servers of first priority group that has MinServers servers up get requests,
+//	other servers that are up are moved to Standby
+//
+func (p *Pool[S]) UpdateBroken() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.update()
+}
+
+//	UpdateBroken with lock held
+//
+func (p *Pool[S]) update() {
+	used := make(map[S]bool, len(p.Servers))
+	for _, srv := range p.Servers {
+		used[srv] = true
+	}
+	up := make([]S, 0, len(p.Servers)+len(p.Standby))
+	broken := make([]S, 0, len(p.Broken))
+	for _, srv := range p.all() {
+		if !srv.Backend().Enabled() || !srv.Backend().health.Healthy() || srv.Backend().Ejected() {
+			broken = append(broken, srv)
+		} else {
+			up = append(up, srv)
+		}
+	}
+	servers, standby := p.activeGroup(up)
+	// servers of new pool start with it and get full weight at once
+	first := p.snap.Load() == nil
+	now := time.Now()
+	for _, srv := range servers {
+		// server is back in pool
+		if !first && !used[srv] && srv.Backend().SlowStart != 0 {
+			p.warmUp(srv.Backend().startWarmUp(now))
+		}
+	}
+	p.Servers = servers
+	p.Standby = standby
+	p.Broken = broken
+	// forget removed servers that have no connections
+	draining := make([]S, 0, len(p.Draining))
+	for _, srv := range p.Draining {
+		if srv.Backend().Active() > 0 {
+			draining = append(draining, srv)
+		}
+	}
+	p.Draining = draining
+	snap := &snapshot[S]{
+		servers: servers,
+		items:   make([]balancing.BalanceItem, len(servers)),
+	}
+	for i, srv := range servers {
+		snap.items[i] = srv
+	}
+	// this moves require rebalancing
+	p.balancing.Rebalance(snap.items)
+	p.snap.Store(snap)
+}
+
+//	Split up servers to servers of first priority group that has MinServers servers up
+//	and standby servers. If no group has enough servers, all up servers are used
+//	Order of servers is kept
+//
+func (p *Pool[S]) activeGroup(up []S) ([]S, []S) {
+	minServers := p.MinServers
+	if minServers < 1 {
+		minServers = 1
+	}
+	var best *Server
+	for _, srv := range up {
+		if best != nil && !srv.Backend().before(best) {
+			continue
+		}
+		n := 0
+		for _, other := range up {
+			if other.Backend().sameGroup(srv.Backend()) {
+				n++
+			}
+		}
+		if n >= minServers {
+			best = srv.Backend()
+		}
+	}
+	if best == nil {
+		return up, make([]S, 0)
+	}
+	servers := make([]S, 0, len(up))
+	standby := make([]S, 0)
+	for _, srv := range up {
+		if srv.Backend().sameGroup(best) {
+			servers = append(servers, srv)
+		} else {
+			standby = append(standby, srv)
+		}
+	}
+	return servers, standby
+}
+
+//	Return all servers of pool in config order: servers that get connections,
+//	standby, backup and broken servers
+//
+func (p *Pool[S]) Members() []S {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.all()
+}
+
+//	Return all servers of pool in config order
+//	Must be called with lock held
+//
+func (p *Pool[S]) all() []S {
+	return append([]S{}, p.members...)
+}
+
+//	Remember that weights of servers change until end
+//
+func (p *Pool[S]) warmUp(end time.Time) {
+	for {
+		until := atomic.LoadInt64(&p.warmUntil)
+		if until >= end.UnixNano() || atomic.CompareAndSwapInt64(&p.warmUntil, until, end.UnixNano()) {
+			return
+		}
+	}
+}
+
+//	Rebalance servers if weights of warming servers could change since last rebalance
+//	Servers are rebalanced at most once in slowStartStep and once after last slow start ends
+//	Snapshot of finder can be replaced already, so servers of current snapshot are rebalanced
+//	with lock held, like update does, and balancing never keeps state of old servers
+//
+func (p *Pool[S]) rebalanceWarming() {
+	until := atomic.LoadInt64(&p.warmUntil)
+	if until == 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&p.lastRebalance)
+	if now < until && now-last < int64(slowStartStep) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&p.lastRebalance, last, now) {
+		return
+	}
+	if now >= until {
+		atomic.CompareAndSwapInt64(&p.warmUntil, until, 0)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.balancing.Rebalance(p.snap.Load().(*snapshot[S]).items)
+}
+
+//	Find available server by checked balancing method
+//	Servers are read from pool snapshot, so health updates don't block finding
+//
+func (s *Pool[S]) FindServer(ip string) (S, error) {
+	s.rebalanceWarming()
+	snap := s.snap.Load().(*snapshot[S])
+	srv, err := s.balancing.FindServer(ip, snap.items)
+	if err != nil {
+		var none S
+		return none, err
+	}
+	srvv := srv.(S)
+	return srvv, nil
+}
+
+//	Find available server like FindServer but skip servers from skip
+//	If balancing method returns skipped server, next not skipped server of pool is used
+//
+func (s *Pool[S]) FindServerExcept(ip string, skip map[S]bool) (S, error) {
+	var none S
+	s.rebalanceWarming()
+	snap := s.snap.Load().(*snapshot[S])
+	srv, err := s.balancing.FindServer(ip, snap.items)
+	if err != nil {
+		return none, err
+	}
+	srvv := srv.(S)
+	if !skip[srvv] {
+		return srvv, nil
+	}
+	servers := snap.servers
+	start := 0
+	for i := range servers {
+		if servers[i] == srvv {
+			start = i
+			break
+		}
+	}
+	for i := 1; i < len(servers); i++ {
+		next := servers[(start+i)%len(servers)]
+		if !skip[next] {
+			return next, nil
+		}
+	}
+	return none, fmt.Errorf("no more servers avaible in pool")
+}
+
+//	Enable or disable all servers of pool with address addr
+//	Return number of changed servers
+//
+func (p *Pool[S]) SetEnabled(addr string, enabled bool) int {
+	p.mu.RLock()
+	n := 0
+	for _, srv := range p.all() {
+		if srv.Address() == addr && srv.Backend().Enabled() != enabled {
+			srv.Backend().SetEnabled(enabled)
+			n++
+		}
+	}
+	p.mu.RUnlock()
+	if n != 0 {
+		p.UpdateBroken()
+	}
+	return n
+}
+
+//	Put all servers of pool with address addr in maintenance
+//	Return number of changed servers
+//
+func (p *Pool[S]) SetMaintenance(addr string) int {
+	p.mu.RLock()
+	n := 0
+	for _, srv := range p.all() {
+		if srv.Address() == addr && !srv.Backend().InMaintenance() {
+			srv.Backend().SetMaintenance()
+			n++
+		}
+	}
+	p.mu.RUnlock()
+	if n != 0 {
+		p.UpdateBroken()
+	}
+	return n
+}
+
+//	Set weight of all servers of pool with address addr and rebalance pool
+//	Return number of changed servers
+//
+func (p *Pool[S]) SetWeight(addr string, weight int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, srv := range p.members {
+		if srv.Address() == addr && srv.GetWeight() != weight {
+			srv.Backend().SetWeight(weight)
+			n++
+		}
+	}
+	if n != 0 {
+		p.update()
+	}
+	return n
+}
+
+//	Create servers from config and add they to pool
+//	Servers added this way are lost on reload
+//	Return number of added servers
+//
+func (p *Pool[S]) AddServer(c config.Server) (int, error) {
+	srvs, err := ServersFromConfig(c)
+	if err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, srv := range srvs {
+		for _, member := range p.members {
+			if member.Address() == srv.Addr {
+				return 0, fmt.Errorf("server %s is already in pool", srv.Addr)
+			}
+		}
+	}
+	for _, srv := range srvs {
+		p.addServer(p.wrap(srv), "control")
+	}
+	p.update()
+	return len(srvs), nil
+}
+
+//	Remove servers with address addr from pool
+//	Removed servers get no new connections and are kept in Draining until their connections end
+//	Servers of host names and servers file can not be removed, they would be added back
+//	Return number of removed servers
+//
+func (p *Pool[S]) RemoveServer(addr string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	srvs := make([]S, 0)
+	for _, srv := range p.members {
+		if srv.Address() != addr {
+			continue
+		}
+		if host := srv.Backend().Host; host != "" {
+			return 0, fmt.Errorf("server %s is address of host name %s", addr, host)
+		}
+		if p.file != nil && p.file.servers[addr] == srv {
+			return 0, fmt.Errorf("server %s is read from servers file %s", addr, p.file.path)
+		}
+		srvs = append(srvs, srv)
+	}
+	for _, srv := range srvs {
+		p.removeServer(srv, "control")
+	}
+	if len(srvs) != 0 {
+		p.update()
+	}
+	return len(srvs), nil
+}
+
+//	Return current state of pool servers
+//
+func (p *Pool[S]) Status(name string) status.Pool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	srvs := make([]status.Server, 0, len(p.Servers)+len(p.Standby)+len(p.Broken))
+	for _, srv := range p.Servers {
+		srvs = append(srvs, srv.Backend().Status())
+	}
+	for _, srv := range p.Standby {
+		st := srv.Backend().Status()
+		if st.State == status.StateUp {
+			st.State = status.StateStandby
+		}
+		srvs = append(srvs, st)
+	}
+	for _, srv := range p.Broken {
+		srvs = append(srvs, srv.Backend().Status())
+	}
+	for _, srv := range p.Draining {
+		if srv.Backend().Active() == 0 {
+			continue
+		}
+		st := srv.Backend().Status()
+		st.State = status.StateDraining
+		srvs = append(srvs, st)
+	}
+	return status.Pool{
+		Name:      name,
+		Balancing: p.Balancing,
+		Servers:   srvs,
+	}
+}
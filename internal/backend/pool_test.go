@@ -0,0 +1,267 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/averageNetAdmin/andproxy/internal/balancing"
+	"github.com/averageNetAdmin/andproxy/internal/config"
+	"github.com/averageNetAdmin/andproxy/internal/dns"
+)
+
+func self(s *Server) *Server { return s }
+
+//	Set static resolver for test and return pool with one server of host name
+//
+func hostPool(t *testing.T, r dns.Static) (*Pool[*Server], *host[*Server]) {
+	old := dns.Default()
+	dns.SetDefault(r)
+	t.Cleanup(func() { dns.SetDefault(old) })
+	p, err := PoolFromConfig([]config.Server{{Addr: "backend.test"}}, "", 0, nil, 80, self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.hosts) != 1 {
+		t.Fatalf("got %d hosts, want 1", len(p.hosts))
+	}
+	return p, p.hosts[0]
+}
+
+func addrs(srvs []*Server) []string {
+	res := make([]string, len(srvs))
+	for i, srv := range srvs {
+		res[i] = srv.Addr
+	}
+	sort.Strings(res)
+	return res
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHostAddressAdded(t *testing.T) {
+	r := dns.Static{"backend.test": {"10.0.0.1"}}
+	p, h := hostPool(t, r)
+	r["backend.test"] = []string{"10.0.0.1", "10.0.0.2"}
+	old := p.members[0]
+	p.resolveHost(h)
+
+	if got := addrs(p.members); !equal(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("members %v, want 10.0.0.1 and 10.0.0.2", got)
+	}
+	if got := addrs(p.Servers); !equal(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("servers %v, want 10.0.0.1 and 10.0.0.2", got)
+	}
+	// server of address that is still resolved is kept with its state
+	if h.servers["10.0.0.1"] != old {
+		t.Fatal("server of kept address is replaced")
+	}
+}
+
+func TestHostAddressRemoved(t *testing.T) {
+	r := dns.Static{"backend.test": {"10.0.0.1", "10.0.0.2"}}
+	p, h := hostPool(t, r)
+	removed := h.servers["10.0.0.2"]
+	removed.Begin()
+	r["backend.test"] = []string{"10.0.0.1"}
+	p.resolveHost(h)
+
+	if got := addrs(p.members); !equal(got, []string{"10.0.0.1"}) {
+		t.Fatalf("members %v, want 10.0.0.1", got)
+	}
+	if len(p.Draining) != 1 || p.Draining[0] != removed {
+		t.Fatalf("draining %v, want 10.0.0.2", addrs(p.Draining))
+	}
+	for i := 0; i < 10; i++ {
+		srv, err := p.FindServer("client")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if srv == removed {
+			t.Fatal("removed server is found")
+		}
+	}
+	// server is forgotten when its connections end
+	removed.Done()
+	r["backend.test"] = []string{"10.0.0.1", "10.0.0.3"}
+	p.resolveHost(h)
+	if len(p.Draining) != 0 {
+		t.Fatalf("draining %v, want none", addrs(p.Draining))
+	}
+}
+
+func TestHostLookupFailed(t *testing.T) {
+	r := dns.Static{"backend.test": {"10.0.0.1", "10.0.0.2"}}
+	p, h := hostPool(t, r)
+	delete(r, "backend.test")
+	p.resolveHost(h)
+
+	if got := addrs(p.members); !equal(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("members %v, want old addresses 10.0.0.1 and 10.0.0.2", got)
+	}
+	if len(p.Draining) != 0 {
+		t.Fatalf("draining %v, want none", addrs(p.Draining))
+	}
+}
+
+//	Return pool of n servers with addresses 10.0.0.1, 10.0.0.2...
+//
+func testPool(tb testing.TB, n int, method string) *Pool[*Server] {
+	confs := make([]config.Server, n)
+	for i := range confs {
+		confs[i] = config.Server{Addr: fmt.Sprintf("10.0.%d.%d", i/250, i%250+1)}
+	}
+	p, err := PoolFromConfig(confs, method, 0, nil, 80, self)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+// Balancing that remembers servers of last rebalance
+//
+type recorder struct {
+	mu   sync.Mutex
+	last []balancing.BalanceItem
+}
+
+func (r *recorder) Rebalance(p []balancing.BalanceItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = p
+}
+
+func (r *recorder) FindServer(ip string, p []balancing.BalanceItem) (balancing.BalanceItem, error) {
+	return p[0], nil
+}
+
+func TestRebalanceWarmingUsesCurrentSnapshot(t *testing.T) {
+	p := testPool(t, 3, "")
+	r := &recorder{}
+	p.balancing = r
+	// finder loaded snapshot before servers are changed
+	stale := p.snap.Load().(*snapshot[*Server])
+	p.SetEnabled("10.0.0.2", false)
+	atomic.StoreInt64(&p.warmUntil, time.Now().Add(time.Hour).UnixNano())
+	atomic.StoreInt64(&p.lastRebalance, 0)
+	if _, err := p.FindServer("client"); err != nil {
+		t.Fatal(err)
+	}
+	current := p.snap.Load().(*snapshot[*Server])
+	if current == stale {
+		t.Fatal("snapshot is not replaced")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.last) != len(current.items) || &r.last[0] != &current.items[0] {
+		t.Fatalf("rebalanced %d servers, not servers of current snapshot", len(r.last))
+	}
+}
+
+//	Find servers while pool is changed, run with -race
+//
+func TestFindServerConcurrentChanges(t *testing.T) {
+	for _, method := range []string{"roundrobin", "random", "consistent", "leastconnections", "ewma"} {
+		t.Run(method, func(t *testing.T) {
+			p := testPool(t, 10, method)
+			// servers warm up, so finders rebalance too
+			for _, srv := range p.members {
+				srv.SlowStart = time.Hour
+			}
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; ; j++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						if j%50 == 0 {
+							atomic.StoreInt64(&p.lastRebalance, 0)
+						}
+						srv, err := p.FindServerExcept(fmt.Sprintf("10.1.%d.%d", i, j%250), nil)
+						if err != nil {
+							continue
+						}
+						srv.Begin()
+						srv.Observe(time.Millisecond)
+						srv.Done()
+					}
+				}(i)
+			}
+			for i := 0; i < 50; i++ {
+				addr := fmt.Sprintf("10.0.0.%d", i%10+1)
+				p.SetEnabled(addr, false)
+				p.SetWeight(addr, i%5+1)
+				p.SetEnabled(addr, true)
+				if _, err := p.AddServer(config.Server{Addr: "10.0.1.1"}); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := p.RemoveServer("10.0.1.1"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func benchmarkFindServer(b *testing.B, method string, update bool) {
+	p := testPool(b, 10, method)
+	stop := make(chan struct{})
+	defer close(stop)
+	if update {
+		// health checks and other changes replace snapshot all the time
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				p.UpdateBroken()
+			}
+		}()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := p.FindServer("10.1.0.1"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFindServer(b *testing.B) {
+	for _, method := range []string{"roundrobin", "random", "consistent", "leastconnections"} {
+		b.Run(method, func(b *testing.B) { benchmarkFindServer(b, method, false) })
+	}
+}
+
+//	Finding is not blocked by pool updates, it does not wait for lock
+//
+func BenchmarkFindServerWhileUpdating(b *testing.B) {
+	for _, method := range []string{"roundrobin", "random", "consistent", "leastconnections"} {
+		b.Run(method, func(b *testing.B) { benchmarkFindServer(b, method, true) })
+	}
+}
@@ -0,0 +1,313 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/averageNetAdmin/andproxy/internal/balancing"
+	"github.com/averageNetAdmin/andproxy/internal/breaker"
+	"github.com/averageNetAdmin/andproxy/internal/config"
+	"github.com/averageNetAdmin/andproxy/internal/dns"
+	"github.com/averageNetAdmin/andproxy/internal/health"
+	"github.com/averageNetAdmin/andproxy/internal/status"
+)
+
+// Administrative states of server
+//
+const (
+	adminEnabled int32 = iota
+	adminDisabled
+	adminMaintenance
+)
+
+//	Representaion of server - everything that have ip address and can get requests
+//	Handlers embed Server and add way to send connections or requests to it
+//
+type Server struct {
+	Addr           string
+	DeadLine       time.Duration
+	WriteDeadLine  time.Duration
+	ReadDeadLine   time.Duration
+	MaxConnections int64
+	MaxConnectTime time.Duration
+	// host name that was resolved to Addr, empty if address is set in config
+	Host string
+	// time in which weight grows to Weight after server is back in pool
+	SlowStart time.Duration
+	// servers with lower priority are used first, backup servers are used after all others
+	Priority int
+	Backup   bool
+
+	weight                   int64
+	breaker                  *breaker.Breaker
+	health                   health.State
+	connectionsNumber        uint64
+	currentConnectionsNumber int64
+	// enabled, disabled or in maintenance
+	admin int32
+	// unix time in nanoseconds when slow start began, 0 if server is not warming up
+	warmStart int64
+	outlier   outlierStats
+	latency   latency
+}
+
+//	Getter to match BalanceItem interface
+//
+func (s *Server) GetWeight() int {
+	return int(atomic.LoadInt64(&s.weight))
+}
+
+//	Change weight of server, pool must be updated after that
+//	Weight is read by balancing without lock, so it is changed atomically
+//
+func (s *Server) SetWeight(weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	atomic.StoreInt64(&s.weight, int64(weight))
+}
+
+//	Getter to match BalanceItem interface
+//	Weight is less than Weight during slow start
+//
+func (s *Server) GetEffectiveWeight() int {
+	start := atomic.LoadInt64(&s.warmStart)
+	if start == 0 {
+		return s.GetWeight()
+	}
+	return balancing.SlowStartWeight(s.GetWeight(), s.SlowStart, time.Unix(0, start))
+}
+
+//	Return true if priority group of server is used before group of other
+//
+func (s *Server) before(other *Server) bool {
+	if s.Backup != other.Backup {
+		return other.Backup
+	}
+	return s.Priority < other.Priority
+}
+
+func (s *Server) sameGroup(other *Server) bool {
+	return s.Backup == other.Backup && s.Priority == other.Priority
+}
+
+//	Begin slow start of server
+//	Return time when slow start ends
+//
+func (s *Server) startWarmUp(now time.Time) time.Time {
+	atomic.StoreInt64(&s.warmStart, now.UnixNano())
+	return now.Add(s.SlowStart)
+}
+
+//	Getter to match BalanceItem interface
+//
+func (s *Server) GetConnNumber() uint64 {
+	return atomic.LoadUint64(&s.connectionsNumber)
+}
+
+//	Stop or resume sending new connections to server
+//	Active connections are not closed. Pool must be updated after that
+//
+func (s *Server) SetEnabled(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&s.admin, adminEnabled)
+	} else {
+		atomic.StoreInt32(&s.admin, adminDisabled)
+	}
+}
+
+//	Put server in maintenance: it gets no new connections and is not checked
+//	Server leaves maintenance when it is enabled. Pool must be updated after that
+//
+func (s *Server) SetMaintenance() {
+	atomic.StoreInt32(&s.admin, adminMaintenance)
+}
+
+//	Return true if server is in maintenance
+//
+func (s *Server) InMaintenance() bool {
+	return atomic.LoadInt32(&s.admin) == adminMaintenance
+}
+
+//	Getter to match health.Target interface
+//
+func (s *Server) Address() string {
+	return s.Addr
+}
+
+//	Return result of server health checks
+//
+func (s *Server) Health() *health.State {
+	return &s.health
+}
+
+//	Return false if server is disabled manually
+//
+func (s *Server) Enabled() bool {
+	return atomic.LoadInt32(&s.admin) == adminEnabled
+}
+
+//	Return current state and counters of server
+//
+func (s *Server) Status() status.Server {
+	state := status.StateUp
+	if s.InMaintenance() {
+		state = status.StateMaintenance
+	} else if !s.Enabled() && s.Active() > 0 {
+		state = status.StateDraining
+	} else if !s.Enabled() {
+		state = status.StateDisabled
+	} else if !s.health.Healthy() {
+		state = status.StateUnhealthy
+	} else if s.Ejected() {
+		state = status.StateEjected
+	} else {
+		switch s.breaker.State() {
+		case breaker.Open:
+			state = status.StateBroken
+		case breaker.HalfOpen:
+			state = status.StateHalfOpen
+		}
+	}
+	br := s.breaker.Status()
+	return status.Server{
+		Addr:        s.Addr,
+		Host:        s.Host,
+		Weight:      s.GetWeight(),
+		Effective:   s.GetEffectiveWeight(),
+		State:       state,
+		Connections: atomic.LoadUint64(&s.connectionsNumber),
+		Active:      atomic.LoadInt64(&s.currentConnectionsNumber),
+		Fails:       br.Fails,
+		Check:       s.health.LastError(),
+		Breaker:     br,
+	}
+}
+
+//	Return number of active connections to server
+//	Getter to match BalanceItem interface
+//
+func (s *Server) Active() int64 {
+	return atomic.LoadInt64(&s.currentConnectionsNumber)
+}
+
+//	Return circuit breaker of server
+//
+func (s *Server) Breaker() *breaker.Breaker {
+	return s.breaker
+}
+
+// Server has MaxConnections active connections
+//
+var ErrFull = errors.New("max parallel connections to server reached")
+
+//	Return server itself, handlers servers that embed Server match Item interface by it
+//
+func (s *Server) Backend() *Server {
+	return s
+}
+
+//	Return true if server has MaxConnections active connections
+//
+func (s *Server) Full() bool {
+	return s.MaxConnections != 0 && atomic.LoadInt64(&s.currentConnectionsNumber) >= s.MaxConnections
+}
+
+//	Count new connection or request to server, it is active until Done is called
+//
+func (s *Server) Begin() {
+	atomic.AddInt64(&s.currentConnectionsNumber, 1)
+	atomic.AddUint64(&s.connectionsNumber, 1)
+}
+
+//	Count end of connection or request that was counted by Begin
+//
+func (s *Server) Done() {
+	atomic.AddInt64(&s.currentConnectionsNumber, -1)
+}
+
+//	Create server with address addr
+//	weight is 1 if it is not positive, connections are not limited if maxConnections is not positive
+//
+func NewServer(addr string, deadLine, writeDeadLine, readDeadLine, maxConnectTime time.Duration,
+	br breaker.Settings, weight int, maxConnections int64) (*Server, error) {
+
+	if net.ParseIP(addr) == nil {
+		return nil, fmt.Errorf("invalid address: %v", addr)
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	if maxConnections <= 0 {
+		maxConnections = 9223372036854775807
+	}
+
+	return &Server{Addr: addr,
+		DeadLine:       deadLine,
+		WriteDeadLine:  writeDeadLine,
+		ReadDeadLine:   readDeadLine,
+		MaxConnectTime: maxConnectTime,
+
+		weight:                   int64(weight),
+		MaxConnections:           maxConnections,
+		breaker:                  breaker.New(addr, br),
+		connectionsNumber:        0,
+		currentConnectionsNumber: 0,
+	}, nil
+}
+
+//	Create server objects from server config
+//	Config address can be range of addresses or host name, one server is created for every address
+//
+func ServersFromConfig(c config.Server) ([]*Server, error) {
+	addrs, err := dns.Addrs(c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	srvs := make([]*Server, 0)
+	for _, address := range addrs {
+		srv, err := serverFromConfig(c, address)
+		if err != nil {
+			return nil, err
+		}
+		srvs = append(srvs, srv)
+	}
+	return srvs, nil
+}
+
+//	Create server with address addr from server config
+//
+func serverFromConfig(c config.Server, addr string) (*Server, error) {
+	srv, err := NewServer(addr, c.DeadLine, c.WriteDeadLine, c.ReadDeadLine, c.MaxConnectTime,
+		breaker.SettingsFromConfig(c), c.Weight, c.MaxConnections)
+	if err != nil {
+		return nil, err
+	}
+	srv.SlowStart = c.SlowStart
+	srv.Priority = c.Priority
+	srv.Backup = c.Backup
+	if dns.IsHostname(c.Addr) {
+		srv.Host = c.Addr
+	}
+	return srv, nil
+}
+
+//	Apply changed server config c to server created from config old
+//	Weight, priority and breaker settings are changed in place, other settings are used by
+//	connections and balancing, so false is returned if they are changed and new server must be created
+//	Must be called with lock of pool held
+//
+func (s *Server) reconfigure(old, c config.Server) bool {
+	if c.DeadLine != old.DeadLine || c.ReadDeadLine != old.ReadDeadLine || c.WriteDeadLine != old.WriteDeadLine ||
+		c.MaxConnectTime != old.MaxConnectTime || c.MaxConnections != old.MaxConnections || c.SlowStart != old.SlowStart {
+		return false
+	}
+	s.SetWeight(c.Weight)
+	s.Priority = c.Priority
+	s.Backup = c.Backup
+	s.breaker.SetSettings(breaker.SettingsFromConfig(c))
+	return true
+}
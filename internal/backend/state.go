@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// State of servers of pools by address
+// It is saved from pools of old config on reload and restored to servers with same
+// addresses in new pools, so servers that are down do not get connections after reload
+//
+type State map[string]serverState
+
+type serverState struct {
+	srv *Server
+	// ejections in a row are guarded by lock of old pool, so they are copied
+	ejections int
+	// server got connections of old pool
+	used bool
+}
+
+//	Save state of servers of pool that are not in st yet
+//
+func (p *Pool[S]) SaveState(st State) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	used := make(map[S]bool, len(p.Servers))
+	for _, srv := range p.Servers {
+		used[srv] = true
+	}
+	for _, srv := range p.all() {
+		if _, ok := st[srv.Address()]; !ok {
+			st[srv.Address()] = serverState{srv: srv.Backend(), ejections: srv.Backend().outlier.ejections, used: used[srv]}
+		}
+	}
+}
+
+//	Give servers of pool state of servers with same address from st:
+//	disabled or maintenance state, health, circuit breaker, ejection and slow start
+//	Servers that got connections of old pool are not warmed up again, other servers
+//	are warmed up if they get connections of new pool
+//
+func (p *Pool[S]) RestoreState(st State) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	current := make(map[S]bool, len(p.Servers))
+	for _, srv := range p.Servers {
+		current[srv] = true
+	}
+	// update warms up servers that are not in Servers, so Servers gets servers that are used already
+	used := make([]S, 0, len(p.Servers))
+	for _, srv := range p.all() {
+		old, ok := st[srv.Address()]
+		if !ok {
+			if current[srv] {
+				used = append(used, srv)
+			}
+			continue
+		}
+		s := srv.Backend()
+		atomic.StoreInt32(&s.admin, atomic.LoadInt32(&old.srv.admin))
+		s.health.CopyFrom(&old.srv.health)
+		s.breaker.CopyState(old.srv.breaker)
+		atomic.StoreInt64(&s.outlier.ejectedUntil, atomic.LoadInt64(&old.srv.outlier.ejectedUntil))
+		atomic.StoreInt64(&s.outlier.consecutive, atomic.LoadInt64(&old.srv.outlier.consecutive))
+		s.outlier.ejections = old.ejections
+		if start := atomic.LoadInt64(&old.srv.warmStart); start != 0 && s.SlowStart != 0 {
+			atomic.StoreInt64(&s.warmStart, start)
+			p.warmUp(time.Unix(0, start).Add(s.SlowStart))
+		}
+		if old.used {
+			used = append(used, srv)
+		}
+		n++
+	}
+	if n != 0 {
+		p.Servers = used
+		p.update()
+	}
+}
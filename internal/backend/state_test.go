@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/averageNetAdmin/andproxy/internal/config"
+)
+
+//	Return pool of servers 10.0.0.1 and 10.0.0.2 with weight 10 and slow start
+//
+func warmingPool(t *testing.T) *Pool[*Server] {
+	confs := []config.Server{
+		{Addr: "10.0.0.1", Weight: 10, SlowStart: time.Hour},
+		{Addr: "10.0.0.2", Weight: 10, SlowStart: time.Hour},
+	}
+	p, err := PoolFromConfig(confs, "", 0, nil, 80, self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+//	Return effective weight of every server of pool by address
+//
+func effective(p *Pool[*Server]) map[string]int {
+	res := make(map[string]int)
+	for _, srv := range p.Members() {
+		res[srv.Addr] = srv.GetEffectiveWeight()
+	}
+	return res
+}
+
+func TestSlowStartNotOnStart(t *testing.T) {
+	p := warmingPool(t)
+	for addr, w := range effective(p) {
+		if w != 10 {
+			t.Fatalf("%s has weight %d after start, want 10", addr, w)
+		}
+	}
+}
+
+func TestReloadKeepsEffectiveWeight(t *testing.T) {
+	old := warmingPool(t)
+	// server is back in pool and warms up
+	old.SetEnabled("10.0.0.2", false)
+	old.SetEnabled("10.0.0.2", true)
+	if w := effective(old)["10.0.0.2"]; w != 1 {
+		t.Fatalf("enabled server has weight %d, want 1", w)
+	}
+
+	st := make(State)
+	old.SaveState(st)
+	p := warmingPool(t)
+	p.RestoreState(st)
+
+	got := effective(p)
+	if got["10.0.0.1"] != 10 {
+		t.Fatalf("server in use has weight %d after reload, want 10", got["10.0.0.1"])
+	}
+	if got["10.0.0.2"] != 1 {
+		t.Fatalf("warming server has weight %d after reload, want 1", got["10.0.0.2"])
+	}
+	if p.warmUntil == 0 {
+		t.Fatal("pool does not rebalance warming server")
+	}
+}
+
+func TestReloadWarmsUpUnusedServer(t *testing.T) {
+	old := warmingPool(t)
+	old.SetEnabled("10.0.0.2", false)
+
+	st := make(State)
+	old.SaveState(st)
+	p := warmingPool(t)
+	p.RestoreState(st)
+	if w := effective(p)["10.0.0.2"]; w != 10 {
+		t.Fatalf("disabled server has weight %d after reload, want 10", w)
+	}
+	// server did not get connections of old pool, so it warms up when it is back
+	p.SetEnabled("10.0.0.2", true)
+	if w := effective(p)["10.0.0.2"]; w != 1 {
+		t.Fatalf("enabled server has weight %d, want 1", w)
+	}
+}
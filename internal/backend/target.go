@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"github.com/averageNetAdmin/andproxy/internal/client"
+	"github.com/averageNetAdmin/andproxy/internal/config"
+)
+
+//	Create servers pool and ip filters of target: tcp or udp handler, site or path
+//	Filters without own health check or outlier detection use ones of target
+//
+func TargetFromConfig[S Item](c config.Target, wrap func(*Server) S) (*Pool[S], []*IPFilter[S], error) {
+	pool, err := poolFromConfig(c.Servers, c.Balancing, c.MinServers, c.HealthCheck, c.OutlierDetection,
+		c.ServersFile, c.ToPort, wrap)
+	if err != nil {
+		return nil, nil, err
+	}
+	// clients can be filtered by source address and they requests sent to different servers
+	filters := make([]*IPFilter[S], 0, len(c.IPFilters))
+	for _, f := range c.IPFilters {
+		check := f.HealthCheck
+		if check == nil {
+			check = c.HealthCheck
+		}
+		outlier := f.OutlierDetection
+		if outlier == nil {
+			outlier = c.OutlierDetection
+		}
+		pool, err := poolFromConfig(f.Servers, f.Balancing, f.MinServers, check, outlier, f.ServersFile, c.ToPort, wrap)
+		if err != nil {
+			return nil, nil, err
+		}
+		source, err := client.New(f.Source...)
+		if err != nil {
+			return nil, nil, err
+		}
+		filters = append(filters, NewFilter(pool, source))
+	}
+	return pool, filters, nil
+}
+
+//	Create pool from servers config, read servers file and set outlier detection if they are set
+//
+func poolFromConfig[S Item](servers []config.Server, balancingMethod string, minServers int, check *config.HealthCheck,
+	outlier *config.OutlierDetection, file config.ServersFile, port int, wrap func(*Server) S) (*Pool[S], error) {
+	pool, err := PoolFromConfig(servers, balancingMethod, minServers, check, port, wrap)
+	if err != nil {
+		return nil, err
+	}
+	if file.Path != "" {
+		err = pool.SetServersFile(file.Path, file.Interval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if outlier != nil {
+		pool.SetOutlierDetection(outlier)
+	}
+	return pool, nil
+}
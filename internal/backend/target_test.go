@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/averageNetAdmin/andproxy/internal/config"
+)
+
+func TestTargetFromConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "servers.json")
+	err := os.WriteFile(file, []byte(`[{"addr": "10.0.2.1"}, {"addr": "10.0.2.2"}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	own := &config.HealthCheck{Port: 8080}
+	c := config.Target{
+		Servers:          []config.Server{{Addr: "10.0.0.1"}},
+		ToPort:           80,
+		HealthCheck:      &config.HealthCheck{},
+		OutlierDetection: &config.OutlierDetection{ConsecutiveErrors: 3},
+		IPFilters: []config.Filter{
+			{Source: []string{"192.168.0.0/24"}, Servers: []config.Server{{Addr: "10.0.1.1"}}},
+			{
+				Source:           []string{"192.168.1.0/24"},
+				HealthCheck:      own,
+				OutlierDetection: &config.OutlierDetection{ConsecutiveErrors: 7},
+				ServersFile:      config.ServersFile{Path: file},
+			},
+		},
+	}
+	pool, filters, err := TargetFromConfig(c, self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := addrs(pool.Members()); !equal(got, []string{"10.0.0.1"}) {
+		t.Fatalf("servers %v, want 10.0.0.1", got)
+	}
+	if pool.Checker() == nil || pool.Checker().Port != "80" {
+		t.Fatalf("checker %v, want check on toport 80", pool.Checker())
+	}
+	if pool.outlier == nil || pool.outlier.ConsecutiveErrors != 3 {
+		t.Fatal("outlier detection of target is not set")
+	}
+	if len(filters) != 2 {
+		t.Fatalf("got %d filters, want 2", len(filters))
+	}
+
+	// first filter uses check and outlier detection of target
+	inherited := filters[0].Servers()
+	if inherited.Checker() == nil || inherited.Checker().Port != "80" {
+		t.Fatalf("filter checker %v, want check of target", inherited.Checker())
+	}
+	if inherited.outlier == nil || inherited.outlier.ConsecutiveErrors != 3 {
+		t.Fatal("filter does not use outlier detection of target")
+	}
+
+	// second filter has own settings and servers from file
+	filtered := filters[1].Servers()
+	if filtered.Checker() == nil || filtered.Checker().Port != "8080" {
+		t.Fatalf("filter checker %v, want own check on port 8080", filtered.Checker())
+	}
+	if filtered.outlier == nil || filtered.outlier.ConsecutiveErrors != 7 {
+		t.Fatal("own outlier detection of filter is not set")
+	}
+	if got := addrs(filtered.Members()); !equal(got, []string{"10.0.2.1", "10.0.2.2"}) {
+		t.Fatalf("filter servers %v, want servers of file", got)
+	}
+}
+
+func TestIPFilterContains(t *testing.T) {
+	c := config.Target{
+		Servers: []config.Server{{Addr: "10.0.0.1"}},
+		ToPort:  80,
+		IPFilters: []config.Filter{
+			{Source: []string{"192.168.0.0/24"}, Servers: []config.Server{{Addr: "10.0.1.1"}}},
+		},
+	}
+	_, filters, err := TargetFromConfig(c, self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// handlers check client addresses with port
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.0.10:5555", true},
+		{"192.168.1.10:5555", false},
+		{"not an address", false},
+	}
+	for _, tt := range tests {
+		got := filters[0].Contains(tt.ip)
+		if (got != nil) != tt.want {
+			t.Errorf("Contains(%q) = %v, want %v", tt.ip, got != nil, tt.want)
+		}
+		if got != nil && got != filters[0].Servers() {
+			t.Errorf("Contains(%q) returned other pool", tt.ip)
+		}
+	}
+}
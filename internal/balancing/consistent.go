@@ -0,0 +1,124 @@
+package balancing
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Points of ring for every server of pool
+//
+const ringPoints = 160
+
+// Filter requests by hash of client ip address or other key of client on ring of servers like ketama
+// Every server has points on ring in proportion to its weight, client goes to server of first
+// point after hash of client. When server is added or removed only clients of its points move
+//
+type Consistent struct {
+	ring *ring
+	mu   sync.RWMutex
+}
+
+// Points of servers sorted by hash
+//
+type ring struct {
+	// servers ring is built for, servers of other pool can't be found by indexes of points
+	items  []BalanceItem
+	hashes []uint64
+	points []int
+}
+
+func (r *ring) Len() int           { return len(r.hashes) }
+func (r *ring) Less(i, j int) bool { return r.hashes[i] < r.hashes[j] }
+func (r *ring) Swap(i, j int) {
+	r.hashes[i], r.hashes[j] = r.hashes[j], r.hashes[i]
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+}
+
+func (m *Consistent) FindServer(sIP string, p []BalanceItem) (BalanceItem, error) {
+	if len(p) == 0 {
+		return nil, fmt.Errorf("no server.Servers avaible in pool")
+	}
+	m.mu.RLock()
+	r := m.ring
+	m.mu.RUnlock()
+	// ring is built for other servers, for example pool is changed while server is found
+	// or balancing is used without Rebalance, so ring of p is built and kept for next finds
+	if r == nil || !r.of(p) {
+		r = newRing(p)
+		m.mu.Lock()
+		m.ring = r
+		m.mu.Unlock()
+	}
+	h := hashString(sIP)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return p[r.points[i]], nil
+}
+
+//	Return true if ring is built for servers p
+//
+func (r *ring) of(p []BalanceItem) bool {
+	return len(r.items) == len(p) && &r.items[0] == &p[0]
+}
+
+// build ring of servers
+//
+func (m *Consistent) Rebalance(p []BalanceItem) {
+	r := newRing(p)
+	m.mu.Lock()
+	m.ring = r
+	m.mu.Unlock()
+}
+
+//	Build ring of ringPoints points for every server, every server gets points in proportion
+//	to its share of weight of pool, so size of ring does not depend on weights
+//	Points of server are first points of sequence of its address, so when share of server
+//	changes, for example weight grows during slow start, its points are only added or removed
+//
+func newRing(p []BalanceItem) *ring {
+	weights := make([]int, len(p))
+	sum := 0
+	for i, item := range p {
+		weights[i] = item.GetEffectiveWeight()
+		sum += weights[i]
+	}
+	counts := make([]int, len(p))
+	total := 0
+	for i := range p {
+		if sum == 0 {
+			// servers without weight get equal points, so ring is not empty
+			counts[i] = ringPoints
+		} else if weights[i] > 0 {
+			counts[i] = int(int64(ringPoints) * int64(len(p)) * int64(weights[i]) / int64(sum))
+			if counts[i] < 1 {
+				counts[i] = 1
+			}
+		}
+		total += counts[i]
+	}
+	r := &ring{
+		items:  p,
+		hashes: make([]uint64, 0, total),
+		points: make([]int, 0, total),
+	}
+	var buf [20]byte
+	for i, item := range p {
+		// point j of server is hash of "<address>-<j>"
+		base := fnv(fnv(fnvOffset, item.Address()), "-")
+		for j := 0; j < counts[i]; j++ {
+			h := base
+			for _, c := range strconv.AppendInt(buf[:0], int64(j), 10) {
+				h ^= uint64(c)
+				h *= fnvPrime
+			}
+			r.hashes = append(r.hashes, mix(h))
+			r.points = append(r.points, i)
+		}
+	}
+	sort.Sort(r)
+	return r
+}
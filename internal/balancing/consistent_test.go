@@ -0,0 +1,126 @@
+package balancing
+
+import (
+	"fmt"
+	"testing"
+)
+
+const testKeys = 10000
+
+//	Return server of every key
+//
+func assign(t *testing.T, m Method, p []BalanceItem) []BalanceItem {
+	m.Rebalance(p)
+	res := make([]BalanceItem, testKeys)
+	for i := range res {
+		srv, err := m.FindServer(fmt.Sprintf("192.168.%d.%d", i/250, i%250), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res[i] = srv
+	}
+	return res
+}
+
+func TestHashServerAdded(t *testing.T) {
+	for _, m := range []Method{&Consistent{}, &HashIP{}} {
+		t.Run(fmt.Sprintf("%T", m), func(t *testing.T) {
+			p := items(11)
+			before := assign(t, m, p[:10])
+			after := assign(t, m, p)
+			moved := 0
+			for i := range before {
+				if before[i] == after[i] {
+					continue
+				}
+				moved++
+				if after[i] != p[10] {
+					t.Fatalf("key %d moved from %s to old server %s", i, before[i].Address(), after[i].Address())
+				}
+			}
+			// new server gets about 1/11 of keys, about 9.1%
+			share := float64(moved) / testKeys
+			if share < 0.06 || share > 0.12 {
+				t.Fatalf("%.1f%% of keys moved, want about 9.1%%", share*100)
+			}
+		})
+	}
+}
+
+func TestHashServerRemoved(t *testing.T) {
+	for _, m := range []Method{&Consistent{}, &HashIP{}} {
+		t.Run(fmt.Sprintf("%T", m), func(t *testing.T) {
+			p := items(10)
+			before := assign(t, m, p)
+			// remove 10.0.0.4
+			rest := append(append([]BalanceItem{}, p[:3]...), p[4:]...)
+			after := assign(t, m, rest)
+			for i := range before {
+				if before[i] != p[3] && before[i] != after[i] {
+					t.Fatalf("key %d of kept server %s moved to %s", i, before[i].Address(), after[i].Address())
+				}
+			}
+		})
+	}
+}
+
+func TestHashWeights(t *testing.T) {
+	for _, m := range []Method{&Consistent{}, &HashIP{}} {
+		t.Run(fmt.Sprintf("%T", m), func(t *testing.T) {
+			p := items(2)
+			p[1].(*item).weight = 3
+			got := 0
+			for _, srv := range assign(t, m, p) {
+				if srv == p[1] {
+					got++
+				}
+			}
+			share := float64(got) / testKeys
+			if share < 0.70 || share > 0.80 {
+				t.Fatalf("server with weight 3 of 4 got %.1f%% of keys, want about 75%%", share*100)
+			}
+		})
+	}
+}
+
+func TestConsistentRingSize(t *testing.T) {
+	p := items(4)
+	for i, w := range []int{1000, 1000, 2000, 1} {
+		p[i].(*item).weight = w
+	}
+	r := newRing(p)
+	if len(r.hashes) > ringPoints*len(p) {
+		t.Fatalf("ring has %d points, want at most %d", len(r.hashes), ringPoints*len(p))
+	}
+	counts := make([]int, len(p))
+	for _, i := range r.points {
+		counts[i]++
+	}
+	// shares are rounded down, server with tiny share keeps one point
+	if counts[0] != counts[1] || counts[2]-2*counts[0] > 1 || counts[2] < 2*counts[0] || counts[3] != 1 {
+		t.Fatalf("servers have %v points, want points in proportion to weight", counts)
+	}
+}
+
+func TestConsistentRingOfOtherServers(t *testing.T) {
+	m := &Consistent{}
+	m.Rebalance(items(3))
+	p := items(3)
+	if _, err := m.FindServer("192.168.0.1", p); err != nil {
+		t.Fatal(err)
+	}
+	// ring of p is kept, so next finds don't build it again
+	if !m.ring.of(p) {
+		t.Fatal("ring of servers is not kept")
+	}
+}
+
+func BenchmarkConsistent(b *testing.B) {
+	m := &Consistent{}
+	p := items(10)
+	m.Rebalance(p)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.FindServer("192.168.0.1", p)
+	}
+}
@@ -0,0 +1,71 @@
+package balancing
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// latency aware balancing: two random servers are compared by peak moving average
+// of their latency multiplied by active connections and divided by weight
+// Servers that respond slower or have more requests in progress get less new requests
+//
+type PeakEWMA struct {
+}
+
+// return server with lower cost of two random servers
+//
+func (m *PeakEWMA) FindServer(sIP string, p []BalanceItem) (BalanceItem, error) {
+	if len(p) == 0 {
+		return nil, fmt.Errorf("no server.Servers avaible in pool")
+	}
+	if len(p) == 1 {
+		return p[0], nil
+	}
+	i := rand.Intn(len(p))
+	// second server is never same as first
+	j := rand.Intn(len(p) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := p[i].Latency(), p[j].Latency()
+	// server without observed latency, like new server, is as slow as slowest server of pool
+	// until its first response, so it doesn't get every request while responses are awaited
+	if a == 0 || b == 0 {
+		peak := maxLatency(p)
+		if a == 0 {
+			a = peak
+		}
+		if b == 0 {
+			b = peak
+		}
+	}
+	if ewmaCost(p[j], b) < ewmaCost(p[i], a) {
+		return p[j], nil
+	}
+	return p[i], nil
+}
+
+// this method is not require rebalancing
+// do nothing
+//
+func (m *PeakEWMA) Rebalance(p []BalanceItem) {}
+
+//	Return expected time of new request to server with latency for its weight
+//
+func ewmaCost(item BalanceItem, latency time.Duration) float64 {
+	return float64(latency+1) * float64(item.Active()+1) / float64(item.GetEffectiveWeight())
+}
+
+//	Return highest latency of servers, 0 if latency of no server is observed
+//	Pool is scanned only when server without latency is compared
+//
+func maxLatency(p []BalanceItem) time.Duration {
+	var peak time.Duration
+	for _, item := range p {
+		if l := item.Latency(); l > peak {
+			peak = l
+		}
+	}
+	return peak
+}
@@ -0,0 +1,109 @@
+package balancing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeakEWMANewServer(t *testing.T) {
+	warm := &item{addr: "10.0.0.1", weight: 1, latency: 10 * time.Millisecond}
+	cold := &item{addr: "10.0.0.2", weight: 1}
+	p := []BalanceItem{warm, cold}
+	m := &PeakEWMA{}
+
+	// new server waits for its first response and must not get next request
+	cold.active = 1
+	for i := 0; i < 100; i++ {
+		srv, err := m.FindServer("", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if srv != warm {
+			t.Fatal("new server with request in progress is used")
+		}
+	}
+
+	// idle new server is as good as slowest server
+	cold.active = 0
+	got := 0
+	for i := 0; i < 1000; i++ {
+		srv, _ := m.FindServer("", p)
+		if srv == cold {
+			got++
+		}
+	}
+	if got < 300 || got > 700 {
+		t.Fatalf("idle new server got %d of 1000 requests, want about half", got)
+	}
+}
+
+func TestPeakEWMALatency(t *testing.T) {
+	fast := &item{addr: "10.0.0.1", weight: 1, latency: time.Millisecond}
+	slow := &item{addr: "10.0.0.2", weight: 1, latency: 100 * time.Millisecond}
+	p := []BalanceItem{fast, slow}
+	m := &PeakEWMA{}
+	for i := 0; i < 100; i++ {
+		srv, err := m.FindServer("", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if srv != fast {
+			t.Fatal("slow server is used")
+		}
+	}
+}
+
+func TestPeakEWMA(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b item
+		want string
+	}{
+		{
+			name: "lower latency",
+			a:    item{addr: "a", weight: 1, latency: 20 * time.Millisecond},
+			b:    item{addr: "b", weight: 1, latency: 10 * time.Millisecond},
+			want: "b",
+		},
+		{
+			name: "latency for active connections",
+			a:    item{addr: "a", weight: 1, latency: 10 * time.Millisecond, active: 3},
+			b:    item{addr: "b", weight: 1, latency: 20 * time.Millisecond},
+			want: "b",
+		},
+		{
+			name: "latency for weight",
+			a:    item{addr: "a", weight: 4, latency: 20 * time.Millisecond},
+			b:    item{addr: "b", weight: 1, latency: 10 * time.Millisecond},
+			want: "a",
+		},
+		{
+			name: "server without latency is as slow as slowest server",
+			a:    item{addr: "a", weight: 1, latency: 10 * time.Millisecond},
+			b:    item{addr: "b", weight: 1, active: 1},
+			want: "a",
+		},
+		{
+			name: "server without latency and busy slowest server",
+			a:    item{addr: "a", weight: 1, latency: 10 * time.Millisecond, active: 1},
+			b:    item{addr: "b", weight: 1},
+			want: "b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// pool of two servers, so both of they are always compared
+			p := []BalanceItem{&tt.a, &tt.b}
+			m := &PeakEWMA{}
+			for i := 0; i < 20; i++ {
+				srv, err := m.FindServer("", p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if srv.Address() != tt.want {
+					t.Fatalf("got %s, want %s", srv.Address(), tt.want)
+				}
+			}
+		})
+	}
+}
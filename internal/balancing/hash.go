@@ -0,0 +1,35 @@
+package balancing
+
+// Parameters of 64-bit fnv-1a
+//
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+//	Return 64-bit hash of s, fnv-1a with bits mixed like in murmur3 finalizer
+//
+func hashString(s string) uint64 {
+	return mix(fnv(fnvOffset, s))
+}
+
+//	Continue fnv-1a hash h with bytes of s
+//
+func fnv(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime
+	}
+	return h
+}
+
+//	Mix bits of hash like murmur3 finalizer, fnv mixes high bits badly
+//
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
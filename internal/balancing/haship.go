@@ -2,46 +2,42 @@ package balancing
 
 import (
 	"fmt"
-	"hash/fnv"
-	"sync"
+	"math"
 )
 
-// Filter requests by client ip address hash
-// Client always go to same server
+// Filter requests by hash of client ip address or other key of client, like http header
+// Client always go to same server while server is in pool. Server is chosen by weighted
+// rendezvous hashing, so when servers are added or removed only clients of that servers move
 //
-type HashIP struct {
-	weightMap map[int]int
-	mu        sync.RWMutex
-}
+type HashIP struct{}
 
 func (m *HashIP) FindServer(sIP string, p []BalanceItem) (BalanceItem, error) {
 	if len(p) == 0 {
 		return nil, fmt.Errorf("no server.Servers avaible in pool")
 	}
-	h := fnv.New32a()
-	h.Write([]byte(sIP))
-	m.mu.RLock()
-	srv := p[m.weightMap[int(h.Sum32())%len(m.weightMap)]]
-	m.mu.RUnlock()
-	return srv, nil
-}
-
-// If count of servers was changed, weight map must be changed
-// 
-func (m *HashIP) Rebalance(p []BalanceItem) {
-	if len(p) == 0 {
-		return
-	}
-	counter := 0
-	m.mu.Lock()
-	// count all servers
-	// create one or more linsk to all servers
-	// quantity of links to one server proportional server weight
+	var srv BalanceItem
+	best := 0.0
 	for i := 0; i < len(p); i++ {
-		for ii := p[i].GetWeight(); ii > 0; ii-- {
-			m.weightMap[counter] = i
-			counter++
+		score := rendezvousScore(sIP, p[i].Address(), p[i].GetEffectiveWeight())
+		if srv == nil || score > best {
+			srv = p[i]
+			best = score
 		}
 	}
-	m.mu.Unlock()
+	return srv, nil
+}
+
+// Nothing to rebalance, every client is hashed with servers of pool
+//
+func (m *HashIP) Rebalance(p []BalanceItem) {}
+
+//	Return score of server for client, server with highest score gets client
+//	Score is weight / -ln(h), where h is hash of client and server in (0, 1),
+//	so share of clients of server is proportional to its weight
+//
+func rendezvousScore(client, server string, weight int) float64 {
+	// fnv-1a of client and server with separator between they
+	h := mix(fnv(fnv(fnvOffset, client)*fnvPrime, server))
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	return float64(weight) / -math.Log(u)
 }
@@ -2,23 +2,28 @@ package balancing
 
 import (
 	"fmt"
+	"sync/atomic"
 )
 
-// connect to server 
+// connect to server with least active connections for its weight
 //
 type LeastConnections struct {
+	// servers with same load are chosen in turn starting from next
+	next uint64
 }
 
-// find server with least connections number and return it (with weight)
+// find server with least active connections number divided by weight and return it
 //
 func (m *LeastConnections) FindServer(sIP string, p []BalanceItem) (BalanceItem, error) {
 	if len(p) == 0 {
 		return nil, fmt.Errorf("no server.Servers avaible in pool")
 	}
-	srv := p[0]
+	start := int(atomic.AddUint64(&m.next, 1) % uint64(len(p)))
+	srv := p[start]
 	for i := 1; i < len(p); i++ {
-		if p[i].GetConnNumber()/uint64(srv.GetWeight()) < srv.GetConnNumber() {
-			srv = p[i]
+		item := p[(start+i)%len(p)]
+		if lessLoaded(item, srv) {
+			srv = item
 		}
 	}
 	return srv, nil
@@ -30,3 +35,10 @@ func (m *LeastConnections) FindServer(sIP string, p []BalanceItem) (BalanceItem,
 func (m *LeastConnections) Rebalance(p []BalanceItem) {
 
 }
+
+//	Return true if a has less active connections than b for its weight
+//	Connection that would be sent is counted, so from idle servers server with bigger weight is chosen
+//
+func lessLoaded(a, b BalanceItem) bool {
+	return (a.Active()+1)*int64(b.GetEffectiveWeight()) < (b.Active()+1)*int64(a.GetEffectiveWeight())
+}
@@ -0,0 +1,55 @@
+package balancing
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLeastConnections(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []item
+		want  string
+	}{
+		{
+			name:  "least active connections",
+			items: []item{{addr: "a", weight: 1, active: 2}, {addr: "b", weight: 1, active: 1}, {addr: "c", weight: 1, active: 3}},
+			want:  "bbbb",
+		},
+		{
+			name:  "active connections for weight",
+			items: []item{{addr: "a", weight: 3, active: 4}, {addr: "b", weight: 1, active: 2}},
+			want:  "aaaa",
+		},
+		{
+			name:  "idle servers by weight",
+			items: []item{{addr: "a", weight: 1}, {addr: "b", weight: 2}, {addr: "c", weight: 1}},
+			want:  "bbbb",
+		},
+		{
+			name:  "same load in turn",
+			items: []item{{addr: "a", weight: 1, active: 1}, {addr: "b", weight: 2, active: 3}, {addr: "c", weight: 1, active: 1}},
+			want:  "bcab",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := make([]BalanceItem, len(tt.items))
+			for i := range tt.items {
+				p[i] = &tt.items[i]
+			}
+			m := &LeastConnections{}
+			var got strings.Builder
+			for range tt.want {
+				srv, err := m.FindServer("", p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got.WriteString(srv.Address())
+			}
+			if got.String() != tt.want {
+				t.Fatalf("got %s, want %s", got.String(), tt.want)
+			}
+		})
+	}
+}
@@ -2,13 +2,42 @@ package balancing
 
 import (
 	"fmt"
+	"time"
 )
 
 // interface to object that can be balanced
 //
 type BalanceItem interface {
 	GetWeight() int
+	// weight that is used for balancing, it is less than weight during slow start
+	GetEffectiveWeight() int
+	// number of connections since start
 	GetConnNumber() uint64
+	// number of connections or requests that are in progress
+	Active() int64
+	// moving average of connect time or time to first byte of response
+	Latency() time.Duration
+	// address of server, hash balancing uses it to keep clients on same server
+	Address() string
+}
+
+//	Return weight of server that is in slow start since start
+//	Weight grows linearly from 1 to weight during slowStart
+//	If slowStart is 0 or start is zero full weight is returned
+//
+func SlowStartWeight(weight int, slowStart time.Duration, start time.Time) int {
+	if slowStart <= 0 || start.IsZero() {
+		return weight
+	}
+	elapsed := time.Since(start)
+	if elapsed >= slowStart {
+		return weight
+	}
+	w := int(int64(weight) * int64(elapsed) / int64(slowStart))
+	if w < 1 {
+		w = 1
+	}
+	return w
 }
 
 // Interface to balancing method
@@ -23,15 +52,21 @@ type Method interface {
 func NewMethod(name string) (Method, error) {
 	switch name {
 	case "roundrobin":
-		return &RoundRobin{counter: 0, weightCounter: 1}, nil
+		return &RoundRobin{}, nil
 	case "none":
 		return &None{}, nil
 	case "random":
-		return &Random{weightMap: make(map[int]int)}, nil
+		return &Random{}, nil
 	case "haship":
-		return &HashIP{weightMap: make(map[int]int)}, nil
+		return &HashIP{}, nil
+	case "consistent":
+		return &Consistent{}, nil
 	case "leastconnections":
 		return &LeastConnections{}, nil
+	case "p2c":
+		return &PowerOfTwo{}, nil
+	case "ewma":
+		return &PeakEWMA{}, nil
 	default:
 		return nil, fmt.Errorf("%s balancing method not exist", name)
 	}
@@ -0,0 +1,32 @@
+package balancing
+
+import (
+	"fmt"
+	"time"
+)
+
+// Server for balancing tests
+//
+type item struct {
+	addr    string
+	weight  int
+	active  int64
+	latency time.Duration
+}
+
+func (i *item) GetWeight() int          { return i.weight }
+func (i *item) GetEffectiveWeight() int { return i.weight }
+func (i *item) GetConnNumber() uint64   { return 0 }
+func (i *item) Active() int64           { return i.active }
+func (i *item) Latency() time.Duration  { return i.latency }
+func (i *item) Address() string         { return i.addr }
+
+//	Return n servers with weight 1 and addresses 10.0.0.1, 10.0.0.2...
+//
+func items(n int) []BalanceItem {
+	p := make([]BalanceItem, n)
+	for i := range p {
+		p[i] = &item{addr: fmt.Sprintf("10.0.0.%d", i+1), weight: 1}
+	}
+	return p
+}
@@ -10,29 +10,23 @@ import (
 type None struct {
 }
 
-// return first server in pool
+// return first server with highest weight
+// servers are not sorted in place, because pool can be used by other goroutines
 //
 func (m *None) FindServer(sIP string, p []BalanceItem) (BalanceItem, error) {
 	if len(p) == 0 {
 		return nil, fmt.Errorf("no server.Servers avaible in pool")
 	}
 	srv := p[0]
+	for i := 1; i < len(p); i++ {
+		if srv.GetWeight() < p[i].GetWeight() {
+			srv = p[i]
+		}
+	}
 	return srv, nil
 }
 
-// sort servers by priority
+// this method is not require rebalancing
+// do nothing
 //
-func (m *None) Rebalance(p []BalanceItem) {
-	if len(p) == 0 {
-		return
-	}
-	weight := 0
-	highPriority := 0
-	for i := 0; i < len(p); i++ {
-		if weight < p[i].GetWeight() {
-			highPriority = i
-			weight = p[i].GetWeight()
-		}
-	}
-	p[0], p[highPriority] = p[highPriority], p[0]
-}
+func (m *None) Rebalance(p []BalanceItem) {}
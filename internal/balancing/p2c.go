@@ -0,0 +1,39 @@
+package balancing
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// power of two random choices: two random servers are compared and
+// server with less active connections for its weight is used
+// Time does not depend on number of servers, so it is used for big pools
+//
+type PowerOfTwo struct {
+}
+
+// return less loaded server of two random servers
+//
+func (m *PowerOfTwo) FindServer(sIP string, p []BalanceItem) (BalanceItem, error) {
+	if len(p) == 0 {
+		return nil, fmt.Errorf("no server.Servers avaible in pool")
+	}
+	if len(p) == 1 {
+		return p[0], nil
+	}
+	i := rand.Intn(len(p))
+	// second server is never same as first
+	j := rand.Intn(len(p) - 1)
+	if j >= i {
+		j++
+	}
+	if lessLoaded(p[j], p[i]) {
+		return p[j], nil
+	}
+	return p[i], nil
+}
+
+// this method is not require rebalancing
+// do nothing
+//
+func (m *PowerOfTwo) Rebalance(p []BalanceItem) {}
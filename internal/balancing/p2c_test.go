@@ -0,0 +1,46 @@
+package balancing
+
+import "testing"
+
+func TestPowerOfTwo(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b item
+		want string
+	}{
+		{
+			name: "less active connections",
+			a:    item{addr: "a", weight: 1, active: 3},
+			b:    item{addr: "b", weight: 1, active: 1},
+			want: "b",
+		},
+		{
+			name: "active connections for weight",
+			a:    item{addr: "a", weight: 4, active: 3},
+			b:    item{addr: "b", weight: 1, active: 1},
+			want: "a",
+		},
+		{
+			name: "idle servers by weight",
+			a:    item{addr: "a", weight: 1},
+			b:    item{addr: "b", weight: 3},
+			want: "b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// pool of two servers, so both of they are always compared
+			p := []BalanceItem{&tt.a, &tt.b}
+			m := &PowerOfTwo{}
+			for i := 0; i < 20; i++ {
+				srv, err := m.FindServer("", p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if srv.Address() != tt.want {
+					t.Fatalf("got %s, want %s", srv.Address(), tt.want)
+				}
+			}
+		})
+	}
+}
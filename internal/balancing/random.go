@@ -7,11 +7,16 @@ import (
 	"time"
 )
 
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
 // requsts sends to random server
 //
 type Random struct {
-	// weight map is requires to balancing with weight 
-	weightMap map[int]int
+	// weight map is requires to balancing with weight
+	// every server index is repeated weight times
+	weightMap []int
 	mu        sync.RWMutex
 }
 
@@ -21,28 +26,27 @@ func (m *Random) FindServer(sIP string, p []BalanceItem) (BalanceItem, error) {
 	if len(p) == 0 {
 		return nil, fmt.Errorf("no server.Servers avaible in pool")
 	}
-
-	rand.Seed(time.Now().UnixNano())
 	m.mu.RLock()
-	n := int(rand.Int63()) % len(m.weightMap)
-	srv := p[m.weightMap[n]]
-	m.mu.RUnlock()
-	return srv, nil
+	defer m.mu.RUnlock()
+	if len(m.weightMap) == 0 {
+		return p[rand.Intn(len(p))], nil
+	}
+	// map can be built for other servers of pool, if pool is changed
+	// while server is found, index is kept in range
+	return p[m.weightMap[rand.Intn(len(m.weightMap))]%len(p)], nil
 }
 
 // update weight map
 //
 func (m *Random) Rebalance(p []BalanceItem) {
-	if len(p) == 0 {
-		return
-	}
-	counter := 0
-	m.mu.Lock()
+	// servers can be removed, links to they must not stay in map
+	weightMap := make([]int, 0, len(p))
 	for i := 0; i < len(p); i++ {
-		for ii := p[i].GetWeight(); ii > 0; ii-- {
-			m.weightMap[counter] = i
-			counter++
+		for ii := p[i].GetEffectiveWeight(); ii > 0; ii-- {
+			weightMap = append(weightMap, i)
 		}
 	}
+	m.mu.Lock()
+	m.weightMap = weightMap
 	m.mu.Unlock()
 }
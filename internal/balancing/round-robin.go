@@ -5,10 +5,15 @@ import (
 	"sync"
 )
 
+// smooth weighted round robin like in nginx
+// Every pick current weight of every server grows by its weight, server with biggest
+// current weight is chosen and its current weight is lowered by sum of weights.
+// Servers are interleaved, for weights 3:1:1 order is a, b, a, c, a
+//
 type RoundRobin struct {
-	counter       int
-	weightCounter int
-	mu            sync.RWMutex
+	// current weights of servers, servers that are not in pool are removed on rebalance
+	current map[BalanceItem]int
+	mu      sync.Mutex
 }
 
 // reutrn next server
@@ -17,29 +22,41 @@ func (m *RoundRobin) FindServer(sIP string, p []BalanceItem) (BalanceItem, error
 	if len(p) == 0 {
 		return nil, fmt.Errorf("no servers avaible in pool")
 	}
-	var srv BalanceItem
 	m.mu.Lock()
-	if m.weightCounter >= 1 {
-		m.counter++
-		srv = p[m.counter%len(p)]
-		m.weightCounter = srv.GetWeight()
-	} else {
-		srv = p[m.counter%len(p)]
-		m.weightCounter--
+	defer m.mu.Unlock()
+	if m.current == nil {
+		m.current = make(map[BalanceItem]int, len(p))
+	}
+	total := 0
+	best := -1
+	bestWeight := 0
+	for i, item := range p {
+		weight := item.GetEffectiveWeight()
+		total += weight
+		// new server starts from zero
+		current := m.current[item] + weight
+		m.current[item] = current
+		if best == -1 || current > bestWeight {
+			best = i
+			bestWeight = current
+		}
 	}
-	m.mu.Unlock()
-	return srv, nil
+	m.current[p[best]] -= total
+	return p[best], nil
 }
 
-// update summary weight
+// forget servers that are not in pool
 //
 func (m *RoundRobin) Rebalance(p []BalanceItem) {
-	if len(p) == 0 {
-		return
-	}
 	m.mu.Lock()
-	if m.weightCounter > p[m.counter%len(p)].GetWeight() {
-		m.weightCounter = p[m.counter%len(p)].GetWeight()
+	defer m.mu.Unlock()
+	in := make(map[BalanceItem]bool, len(p))
+	for _, item := range p {
+		in[item] = true
+	}
+	for item := range m.current {
+		if !in[item] {
+			delete(m.current, item)
+		}
 	}
-	m.mu.Unlock()
 }
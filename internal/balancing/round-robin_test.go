@@ -0,0 +1,96 @@
+package balancing
+
+import (
+	"strings"
+	"testing"
+)
+
+// Pool of round robin test and servers that are expected from it
+// Pool is rebalanced before picks if rebalance is set
+//
+type rrStep struct {
+	pool      string
+	rebalance bool
+	want      string
+}
+
+func TestRoundRobin(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		steps   []rrStep
+	}{
+		{
+			name:    "weights 3:1:1",
+			weights: map[string]int{"a": 3, "b": 1, "c": 1},
+			steps:   []rrStep{{pool: "abc", want: "abacaabaca"}},
+		},
+		{
+			name:    "equal weights",
+			weights: map[string]int{"a": 1, "b": 1, "c": 1},
+			steps:   []rrStep{{pool: "abc", want: "abcabc"}},
+		},
+		{
+			name:    "weights 5:1",
+			weights: map[string]int{"a": 5, "b": 1},
+			steps:   []rrStep{{pool: "ab", want: "aaabaa"}},
+		},
+		{
+			name:    "server added",
+			weights: map[string]int{"a": 1, "b": 1, "c": 1},
+			steps: []rrStep{
+				{pool: "ab", want: "ab"},
+				// new server starts from zero
+				{pool: "abc", want: "abcabc"},
+			},
+		},
+		{
+			name:    "server removed",
+			weights: map[string]int{"a": 1, "b": 1, "c": 1},
+			steps: []rrStep{
+				{pool: "abc", want: "ab"},
+				// c waits longest and gets connections it missed
+				{pool: "ac", rebalance: true, want: "ccaca"},
+			},
+		},
+		{
+			name:    "removed server added again",
+			weights: map[string]int{"a": 1, "b": 1, "c": 1},
+			steps: []rrStep{
+				{pool: "abc", want: "a"},
+				{pool: "ac", rebalance: true, want: "c"},
+				// b is forgotten and starts from zero, a and c paid for their picks
+				{pool: "abc", rebalance: true, want: "bcabca"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := make(map[string]*item)
+			for name, weight := range tt.weights {
+				servers[name] = &item{addr: name, weight: weight}
+			}
+			m := &RoundRobin{}
+			for i, step := range tt.steps {
+				p := make([]BalanceItem, 0, len(step.pool))
+				for _, name := range step.pool {
+					p = append(p, servers[string(name)])
+				}
+				if step.rebalance {
+					m.Rebalance(p)
+				}
+				var got strings.Builder
+				for range step.want {
+					srv, err := m.FindServer("", p)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got.WriteString(srv.Address())
+				}
+				if got.String() != step.want {
+					t.Fatalf("step %d with pool %s: got %s, want %s", i, step.pool, got.String(), step.want)
+				}
+			}
+		})
+	}
+}
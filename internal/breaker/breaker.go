@@ -0,0 +1,273 @@
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/averageNetAdmin/andproxy/internal/config"
+	"github.com/averageNetAdmin/andproxy/internal/event"
+	"github.com/averageNetAdmin/andproxy/internal/status"
+)
+
+// Values used if they are not set in server config
+//
+const (
+	DefaultMaxFails  = 5
+	DefaultWindow    = time.Minute
+	DefaultBreakTime = 2 * time.Minute
+	DefaultTrials    = 1
+)
+
+// Returned by servers when breaker does not allow request
+//
+var ErrOpen = errors.New("circuit breaker is open")
+
+// States of breaker
+//
+type State int32
+
+const (
+	// requests are allowed, failures are counted
+	Closed State = iota
+	// requests are not allowed until break time ends
+	Open
+	// limited number of trial requests is allowed
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("state %d", int32(s))
+	}
+}
+
+// Settings of breaker
+//
+type Settings struct {
+	// failures in Window that open breaker
+	MaxFails int
+	Window   time.Duration
+	// time in open state before trial requests are allowed
+	BreakTime time.Duration
+	// trial requests in half-open state, breaker is closed if all of they succeed
+	Trials int
+}
+
+//	Return breaker settings of server config
+//
+func SettingsFromConfig(c config.Server) Settings {
+	return Settings{
+		MaxFails:  c.MaxFails,
+		Window:    c.FailWindow,
+		BreakTime: c.BreakTime,
+		Trials:    c.HalfOpenRequests,
+	}
+}
+
+// Circuit breaker of one server
+// Breaker is opened when MaxFails failures happen in Window. After BreakTime it is half-open
+// and allows Trials requests. Breaker is closed if all trials succeed and opened again if any fails
+//
+type Breaker struct {
+	name     string
+	settings Settings
+
+	mu       sync.Mutex
+	state    State
+	openedAt time.Time
+	// times of failures in window, oldest first
+	failures []time.Time
+	// trial requests in progress and succeeded trial requests
+	trials    int
+	succeeded int
+
+	fails      uint64
+	opened     uint64
+	halfOpened uint64
+	closed     uint64
+}
+
+//	Create closed breaker of server name
+//	Zero settings are replaced by defaults
+//
+func New(name string, s Settings) *Breaker {
+	s = s.withDefaults()
+	return &Breaker{
+		name:     name,
+		settings: s,
+		failures: make([]time.Time, 0, s.MaxFails),
+	}
+}
+
+//	Replace settings of breaker, state and counters are kept
+//	Zero settings are replaced by defaults
+//
+func (b *Breaker) SetSettings(s Settings) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.settings = s.withDefaults()
+}
+
+//	Take state, recent failures and counters of breaker o
+//	Trial requests in progress are counted by o, so they are not taken
+//
+func (b *Breaker) CopyState(o *Breaker) {
+	o.mu.Lock()
+	state, openedAt, succeeded := o.state, o.openedAt, o.succeeded
+	failures := append([]time.Time(nil), o.failures...)
+	fails, opened, halfOpened, closed := o.fails, o.opened, o.halfOpened, o.closed
+	o.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state, b.openedAt, b.succeeded = state, openedAt, succeeded
+	b.trials = 0
+	b.failures = append(b.failures[:0], failures...)
+	b.fails, b.opened, b.halfOpened, b.closed = fails, opened, halfOpened, closed
+}
+
+func (s Settings) withDefaults() Settings {
+	if s.MaxFails <= 0 {
+		s.MaxFails = DefaultMaxFails
+	}
+	if s.Window <= 0 {
+		s.Window = DefaultWindow
+	}
+	if s.BreakTime <= 0 {
+		s.BreakTime = DefaultBreakTime
+	}
+	if s.Trials <= 0 {
+		s.Trials = DefaultTrials
+	}
+	return s
+}
+
+//	Return true if request can be sent to server
+//	If true is returned, Success or Failure must be called with result of request
+//
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.update(time.Now())
+	switch b.state {
+	case Closed:
+		return true
+	case HalfOpen:
+		if b.trials+b.succeeded >= b.settings.Trials {
+			return false
+		}
+		b.trials++
+		return true
+	default:
+		return false
+	}
+}
+
+//	Count successful request
+//
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != HalfOpen {
+		return
+	}
+	if b.trials > 0 {
+		b.trials--
+	}
+	b.succeeded++
+	if b.succeeded >= b.settings.Trials {
+		b.setState(Closed, time.Now(), fmt.Sprintf("%d trial requests succeeded", b.succeeded))
+	}
+}
+
+//	Count failed request
+//
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails++
+	now := time.Now()
+	switch b.state {
+	case HalfOpen:
+		b.setState(Open, now, "trial request failed")
+	case Closed:
+		b.failures = append(b.expire(now), now)
+		if len(b.failures) >= b.settings.MaxFails {
+			b.setState(Open, now, fmt.Sprintf("%d failures in %v", len(b.failures), b.settings.Window))
+		}
+	}
+}
+
+//	Return current state of breaker
+//
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.update(time.Now())
+	return b.state
+}
+
+//	Return current state and counters of breaker
+//
+func (b *Breaker) Status() status.Breaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.update(now)
+	b.failures = b.expire(now)
+	return status.Breaker{
+		State:       b.state.String(),
+		RecentFails: len(b.failures),
+		Fails:       b.fails,
+		Opened:      b.opened,
+		HalfOpened:  b.halfOpened,
+		Closed:      b.closed,
+	}
+}
+
+//	Make open breaker half-open if break time is over
+//
+func (b *Breaker) update(now time.Time) {
+	if b.state == Open && now.Sub(b.openedAt) >= b.settings.BreakTime {
+		b.setState(HalfOpen, now, "")
+	}
+}
+
+//	Return failures that are still in window
+//
+func (b *Breaker) expire(now time.Time) []time.Time {
+	n := 0
+	for n < len(b.failures) && now.Sub(b.failures[n]) >= b.settings.Window {
+		n++
+	}
+	return append(b.failures[:0], b.failures[n:]...)
+}
+
+func (b *Breaker) setState(state State, now time.Time, reason string) {
+	b.state = state
+	b.trials = 0
+	b.succeeded = 0
+	b.failures = b.failures[:0]
+	e := event.Event{Server: b.name, Message: reason}
+	switch state {
+	case Open:
+		b.openedAt = now
+		b.opened++
+		e.Type = event.ServerBroken
+	case HalfOpen:
+		b.halfOpened++
+		e.Type = event.ServerHalfOpen
+	case Closed:
+		b.closed++
+		e.Type = event.ServerRestored
+	}
+	event.Publish(e)
+}
@@ -1,18 +1,22 @@
 package client
 
 import (
+	"fmt"
 	"net"
 	"net/netip"
 	"strings"
+	"sync"
 
 	"github.com/averageNetAdmin/andproxy/internal/ranges"
 )
 
 // Contain pool of addresses and pool of networks
+// Addresses can be added and removed while sources are used
 //
 type Sources struct {
 	Addrs []netip.Addr
 	Nets  []netip.Prefix
+	mu    sync.RWMutex
 }
 
 //	Check is ip address in struct
@@ -28,6 +32,8 @@ func (s *Sources) Contains(searchIP string) bool {
 	}
 	
 	// try find ip in address pool and nets pool
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	for _, a := range s.Addrs {
 		if a.Compare(pHost) == 0 {
 			return true
@@ -44,27 +50,158 @@ func (s *Sources) Contains(searchIP string) bool {
 //	Add net, address, net range or address range
 //
 func (s *Sources) Add(addrs string) error {
-	rng, err := ranges.Create(addrs)
+	addrArr, netArr, err := parse(addrs)
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Addrs = append(s.Addrs, addrArr...)
+	s.Nets = append(s.Nets, netArr...)
+	return nil
+}
+
+//	Remove net, address, net range or address range
+//	Return error and remove nothing if some of addresses are not in sources
+//
+func (s *Sources) Remove(addrs string) error {
+	addrArr, netArr, err := parse(addrs)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	newAddrs, newNets, err := removeAddrs(append([]netip.Addr{}, s.Addrs...), append([]netip.Prefix{}, s.Nets...), addrArr, netArr)
+	if err != nil {
+		return err
+	}
+	s.Addrs = newAddrs
+	s.Nets = newNets
+	return nil
+}
+
+//	Remove addresses and nets of addrArr and netArr from addrs and nets in place
+//	Return error if some of they are not found, addrs and nets are changed partially then
+//
+func removeAddrs(addrs []netip.Addr, nets []netip.Prefix, addrArr []netip.Addr, netArr []netip.Prefix) ([]netip.Addr, []netip.Prefix, error) {
+	for _, addr := range addrArr {
+		i := indexOf(len(addrs), func(i int) bool { return addrs[i] == addr })
+		if i == -1 {
+			return nil, nil, fmt.Errorf("address %s not found", addr)
+		}
+		addrs = append(addrs[:i], addrs[i+1:]...)
+	}
+	for _, net := range netArr {
+		i := indexOf(len(nets), func(i int) bool { return nets[i] == net })
+		if i == -1 {
+			return nil, nil, fmt.Errorf("network %s not found", net)
+		}
+		nets = append(nets[:i], nets[i+1:]...)
+	}
+	return addrs, nets, nil
+}
+
+//	Return number of addresses and nets
+//	Nil sources are empty
+//
+func (s *Sources) Len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.Addrs) + len(s.Nets)
+}
+
+//	Return all addresses and nets as strings
+//
+func (s *Sources) Strings() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]string, 0, len(s.Addrs)+len(s.Nets))
+	for _, addr := range s.Addrs {
+		res = append(res, addr.String())
+	}
+	for _, net := range s.Nets {
+		res = append(res, net.String())
+	}
+	return res
+}
+
+//	Parse net, address, net range or address range
+//
+func parse(addrs string) ([]netip.Addr, []netip.Prefix, error) {
+	rng, err := ranges.Create(addrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		addrArr []netip.Addr
+		netArr  []netip.Prefix
+	)
 	for _, el := range rng {
 		// if string contains "/" it is network else address
 		if strings.Contains(el, "/") {
 			net, err := netip.ParsePrefix(el)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
-			s.Nets = append(s.Nets, net)
+			netArr = append(netArr, net)
 		} else {
 			addr, err := netip.ParseAddr(el)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
-			s.Addrs = append(s.Addrs, addr)
+			addrArr = append(addrArr, addr)
 		}
 	}
+	return addrArr, netArr, nil
+}
 
+func indexOf(n int, eq func(i int) bool) int {
+	for i := 0; i < n; i++ {
+		if eq(i) {
+			return i
+		}
+	}
+	return -1
+}
+
+//	Add addresses to sources or remove they from sources
+//	List is applied to copies of sources that replace they only if every address is changed,
+//	so invalid list or address that is not in sources changes nothing
+//
+func (s *Sources) Update(addrs []string, remove bool) error {
+	addrArrs := make([][]netip.Addr, len(addrs))
+	netArrs := make([][]netip.Prefix, len(addrs))
+	for i, addr := range addrs {
+		var err error
+		addrArrs[i], netArrs[i], err = parse(addr)
+		if err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	newAddrs := append([]netip.Addr{}, s.Addrs...)
+	newNets := append([]netip.Prefix{}, s.Nets...)
+	for i := range addrs {
+		if !remove {
+			newAddrs = append(newAddrs, addrArrs[i]...)
+			newNets = append(newNets, netArrs[i]...)
+			continue
+		}
+		var err error
+		newAddrs, newNets, err = removeAddrs(newAddrs, newNets, addrArrs[i], netArrs[i])
+		if err != nil {
+			return err
+		}
+	}
+	s.Addrs = newAddrs
+	s.Nets = newNets
 	return nil
 }
 
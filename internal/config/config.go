@@ -0,0 +1,669 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Directory where handlers create they log directories if it is not set in config
+//
+const DefaultLogDir = "/var/log/andproxy"
+
+// Content of main config file
+// Servers pools, address pools and filters are defined once and can be
+// referenced by name with $ prefix from any listen port, handler file, path or filter
+//
+type Config struct {
+	Global       Global
+	ListenPorts  map[string]map[string]interface{}
+	Filters      map[string]map[string]interface{}
+	ServersPools map[string]map[string]interface{}
+	Pools        map[string][]interface{}
+
+	src *Source
+}
+
+//	Read main config file
+//	All pools and filters are checked, unknown reference is an error
+//
+func Load(path string) (*Config, error) {
+	raw, src, err := ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{
+		ListenPorts:  make(map[string]map[string]interface{}),
+		Filters:      make(map[string]map[string]interface{}),
+		ServersPools: make(map[string]map[string]interface{}),
+		Pools:        make(map[string][]interface{}),
+		src:          src,
+	}
+	var errs ErrorList
+	for k, v := range raw {
+		switch k {
+		case "global":
+			globalErrs := decode(v, &c.Global, src.Sub("global"))
+			if len(globalErrs) == 0 {
+				globalErrs = c.Global.validate(src.Sub("global"))
+			}
+			errs = append(errs, globalErrs...)
+		case "listenports":
+			errs = append(errs, section(src, k, v, func(name string, v interface{}) bool {
+				if v == nil {
+					v = make(map[string]interface{})
+				}
+				m, ok := v.(map[string]interface{})
+				c.ListenPorts[name] = m
+				return ok
+			})...)
+		case "filters":
+			errs = append(errs, section(src, k, v, func(name string, v interface{}) bool {
+				m, ok := v.(map[string]interface{})
+				c.Filters[name] = m
+				return ok
+			})...)
+		case "serverspools":
+			errs = append(errs, section(src, k, v, func(name string, v interface{}) bool {
+				m, ok := v.(map[string]interface{})
+				c.ServersPools[name] = m
+				return ok
+			})...)
+		case "pools":
+			errs = append(errs, section(src, k, v, func(name string, v interface{}) bool {
+				arr, ok := v.([]interface{})
+				c.Pools[name] = arr
+				return ok
+			})...)
+		default:
+			errs = append(errs, src.errorf(k, "unknown section"))
+		}
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+
+	// check content of pools and references
+	for name := range c.Pools {
+		key := index("pools", name)
+		addrs, err := c.addrs(c.Pools[name])
+		if err != nil {
+			errs = append(errs, src.errorf(key, "%v", err))
+			continue
+		}
+		errs = append(errs, validateAddrs(src, key, toStrings(addrs))...)
+	}
+	for name, pool := range c.ServersPools {
+		for addr, settings := range pool {
+			key := index(index("serverspools", name), addr)
+			srvs, err := c.servers(map[string]interface{}{addr: settings})
+			if err != nil {
+				errs = append(errs, src.errorf(key, "%v", err))
+				continue
+			}
+			var srv Server
+			decodeErrs := decode(srvs[0], &srv, src.Sub(key))
+			if len(decodeErrs) != 0 {
+				errs = append(errs, decodeErrs...)
+				continue
+			}
+			errs = append(errs, srv.validate(src, key)...)
+		}
+	}
+	for name := range c.Filters {
+		key := index("filters", name)
+		filter, err := c.filter(name)
+		if err != nil {
+			errs = append(errs, src.errorf(key, "%v", err))
+			continue
+		}
+		var filters []Filter
+		decodeErrs := decode(filter, &filters, src.Sub(key))
+		if len(decodeErrs) != 0 {
+			errs = append(errs, decodeErrs...)
+			continue
+		}
+		for i := range filters {
+			errs = append(errs, validateAddrs(src, key, filters[i].Source)...)
+		}
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+//	Read yaml file to map
+//	Returned source is used to report errors with line numbers
+//
+func ReadFile(path string) (map[string]interface{}, *Source, error) {
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	src, root, err := newSource(path, configBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := make(map[string]interface{})
+	if root.Kind != 0 {
+		err = root.Decode(config)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	normalize(config, false)
+	return config, src, nil
+}
+
+//	Read servers file
+//	File is list of servers in handler format or map of addresses to servers settings
+//	like servers pool of main config, json is accepted as yaml
+//
+func LoadServers(path string) ([]Server, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseServers(path, data)
+}
+
+//	Parse content of servers file, path is used in errors
+//
+func ParseServers(path string, data []byte) ([]Server, error) {
+	src, root, err := newSource(path, data)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if root.Kind != 0 {
+		err = root.Decode(&raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	// key of every server is kept to report errors
+	var keys []string
+	switch v := raw.(type) {
+	case nil:
+	case []interface{}:
+		for i := range v {
+			keys = append(keys, index("", strconv.Itoa(i)))
+		}
+	case map[string]interface{}:
+		normalize(v, true)
+		// order of servers must not depend on map order
+		list := make([]interface{}, 0, len(v))
+		for _, addr := range sortedKeys(v) {
+			keys = append(keys, index("", addr))
+			list = append(list, map[string]interface{}{addr: v[addr]})
+		}
+		raw = list
+	default:
+		return nil, fmt.Errorf("%s: expected list or map of servers", path)
+	}
+	var errs ErrorList
+	srvs := make([]Server, 0, len(keys))
+	for i, el := range raw.([]interface{}) {
+		conf, err := new(Config).servers([]interface{}{el})
+		if err != nil || len(conf) != 1 {
+			errs = append(errs, src.errorf(keys[i], "invalid server %v", el))
+			continue
+		}
+		var srv Server
+		decodeErrs := decode(conf[0], &srv, src.Sub(keys[i]))
+		if len(decodeErrs) != 0 {
+			errs = append(errs, decodeErrs...)
+			continue
+		}
+		errs = append(errs, srv.validate(src, keys[i])...)
+		srvs = append(srvs, srv)
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return srvs, nil
+}
+
+//	Return handler name (<protocol>_<port>) of listen port key (<protocol> <port>)
+//
+func HandlerName(listenPort string) string {
+	return strings.Join(strings.Fields(listenPort), "_")
+}
+
+//	Return source of listen port config
+//
+func (c *Config) ListenPortSource(listenPort string) *Source {
+	return c.src.Sub(index("listenports", listenPort))
+}
+
+//	Prepare handler config to decoding
+//	Set defaults from global section and replace all references with they content
+//	Config can be nil, then only defaults are set
+//
+func (c *Config) Resolve(name string, handler map[string]interface{}, src *Source) error {
+	if c == nil {
+		c = &Config{}
+	}
+	normalize(handler, false)
+
+	if handler["logdir"] == nil {
+		logDir := c.Global.LogDir
+		if logDir == "" {
+			logDir = DefaultLogDir
+		}
+		handler["logdir"] = filepath.Join(logDir, name)
+	}
+	if handler["graceperiod"] == nil {
+		if c.Global.GracePeriod != 0 {
+			handler["graceperiod"] = c.Global.GracePeriod
+		} else {
+			handler["graceperiod"] = DefaultGracePeriod
+		}
+	}
+
+	errs := c.resolveTarget(handler, "", src)
+	if handler["sites"] == nil {
+		return errs.orNil()
+	}
+	sites, ok := handler["sites"].(map[string]interface{})
+	if !ok {
+		return append(errs, src.errorf("sites", "expected a map"))
+	}
+	for siteName, v := range sites {
+		siteKey := index("sites", siteName)
+		site, ok := v.(map[string]interface{})
+		if !ok {
+			errs = append(errs, src.errorf(siteKey, "expected a map"))
+			continue
+		}
+		errs = append(errs, c.resolveTarget(site, siteKey, src)...)
+		for k, v := range site {
+			if !strings.Contains(k, "/") {
+				continue
+			}
+			path, ok := v.(map[string]interface{})
+			if !ok {
+				errs = append(errs, src.errorf(index(siteKey, k), "expected a map"))
+				continue
+			}
+			errs = append(errs, c.resolveTarget(path, index(siteKey, k), src)...)
+		}
+		// paths can be also set in paths map of site
+		if site["paths"] == nil {
+			continue
+		}
+		paths, ok := site["paths"].(map[string]interface{})
+		if !ok {
+			errs = append(errs, src.errorf(field(siteKey, "paths"), "expected a map"))
+			continue
+		}
+		for k, v := range paths {
+			pathKey := index(field(siteKey, "paths"), k)
+			path, ok := v.(map[string]interface{})
+			if !ok {
+				errs = append(errs, src.errorf(pathKey, "expected a map"))
+				continue
+			}
+			errs = append(errs, c.resolveTarget(path, pathKey, src)...)
+		}
+	}
+	return errs.orNil()
+}
+
+//	Decode tcp or udp handler config
+//	Config must be resolved before
+//
+func DecodeTCP(conf map[string]interface{}, src *Source) (*TCPHandler, error) {
+	h := new(TCPHandler)
+	errs := decode(conf, h, src)
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	errs = h.validate(src)
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return h, nil
+}
+
+//	Decode http or https handler config
+//	Config must be resolved before
+//
+func DecodeHTTP(conf map[string]interface{}, src *Source) (*HTTPHandler, error) {
+	// paths can be set as site keys, they are moved to paths
+	if sites, ok := conf["sites"].(map[string]interface{}); ok {
+		for _, v := range sites {
+			site, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for k, path := range site {
+				if !strings.Contains(k, "/") {
+					continue
+				}
+				paths, ok := site["paths"].(map[string]interface{})
+				if !ok {
+					paths = make(map[string]interface{})
+					site["paths"] = paths
+				}
+				paths[k] = path
+				delete(site, k)
+			}
+		}
+	}
+	h := new(HTTPHandler)
+	errs := decode(conf, h, src)
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	errs = h.validate(src)
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return h, nil
+}
+
+//	Replace references in part of config that describe where requests are sent:
+//	handler, site or path
+//
+func (c *Config) resolveTarget(conf map[string]interface{}, key string, src *Source) ErrorList {
+	var errs ErrorList
+	for _, k := range []string{"accept", "deny"} {
+		if conf[k] == nil {
+			continue
+		}
+		addrs, err := c.addrs(conf[k])
+		if err != nil {
+			errs = append(errs, src.errorf(field(key, k), "%v", err))
+			continue
+		}
+		conf[k] = addrs
+	}
+
+	if conf["servers"] != nil {
+		servers, err := c.servers(conf["servers"])
+		if err != nil {
+			errs = append(errs, src.errorf(field(key, "servers"), "%v", err))
+		} else {
+			conf["servers"] = servers
+		}
+	}
+
+	if conf["balancingmethod"] != nil && conf["balancing"] == nil {
+		conf["balancing"] = conf["balancingmethod"]
+	}
+	delete(conf, "balancingmethod")
+	if balancing, ok := conf["balancing"].(string); ok {
+		conf["balancing"] = strings.ToLower(balancing)
+	}
+
+	// filters are converted to ip filters
+	if conf["filters"] != nil {
+		filtersKey := field(key, "filters")
+		var names []interface{}
+		switch v := conf["filters"].(type) {
+		case string:
+			names = []interface{}{v}
+		case []interface{}:
+			names = v
+		default:
+			return append(errs, src.errorf(filtersKey, "expected reference to filter or list of references"))
+		}
+		ipfilters, _ := conf["ipfilters"].([]interface{})
+		for _, v := range names {
+			ref, ok := v.(string)
+			if !ok || !strings.HasPrefix(ref, "$") {
+				errs = append(errs, src.errorf(filtersKey, "invalid filter reference %v", v))
+				continue
+			}
+			filter, err := c.filter(ref[1:])
+			if err != nil {
+				errs = append(errs, src.errorf(filtersKey, "%v", err))
+				continue
+			}
+			ipfilters = append(ipfilters, filter...)
+		}
+		conf["ipfilters"] = ipfilters
+		delete(conf, "filters")
+	}
+
+	if conf["ipfilters"] != nil {
+		ipfilters, ok := conf["ipfilters"].([]interface{})
+		if !ok {
+			return append(errs, src.errorf(field(key, "ipfilters"), "expected a list"))
+		}
+		for i, v := range ipfilters {
+			filterKey := index(field(key, "ipfilters"), strconv.Itoa(i))
+			filter, ok := v.(map[string]interface{})
+			if !ok {
+				errs = append(errs, src.errorf(filterKey, "expected a map"))
+				continue
+			}
+			errs = append(errs, c.resolveTarget(filter, filterKey, src)...)
+			if filter["source"] != nil {
+				source, err := c.addrs(filter["source"])
+				if err != nil {
+					errs = append(errs, src.errorf(field(filterKey, "source"), "%v", err))
+					continue
+				}
+				filter["source"] = source
+			}
+		}
+	}
+	return errs
+}
+
+//	Return list of addresses
+//	Value can be address, reference to address pool or list of they
+//
+func (c *Config) addrs(v interface{}) ([]interface{}, error) {
+	res := make([]interface{}, 0)
+	switch v := v.(type) {
+	case nil:
+	case string:
+		if !strings.HasPrefix(v, "$") {
+			return append(res, v), nil
+		}
+		pool, ok := c.Pools[v[1:]]
+		if !ok {
+			return nil, fmt.Errorf("unknown address pool %s", v)
+		}
+		for _, addr := range pool {
+			s, ok := addr.(string)
+			if !ok || strings.HasPrefix(s, "$") {
+				return nil, fmt.Errorf("invalid address %v in pool %s", addr, v)
+			}
+			res = append(res, s)
+		}
+	case []interface{}:
+		for _, el := range v {
+			addrs, err := c.addrs(el)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, addrs...)
+		}
+	default:
+		return nil, fmt.Errorf("invalid address %v", v)
+	}
+	return res, nil
+}
+
+//	Return list of servers in handler file format - array of maps with addr key
+//	Value can be reference to servers pool, servers pool in main config format
+//	(map of addresses to servers settings) or array of servers, addresses and references
+//
+func (c *Config) servers(v interface{}) ([]interface{}, error) {
+	res := make([]interface{}, 0)
+	switch v := v.(type) {
+	case nil:
+	case string:
+		if !strings.HasPrefix(v, "$") {
+			return append(res, map[string]interface{}{"addr": v}), nil
+		}
+		pool, ok := c.ServersPools[v[1:]]
+		if !ok {
+			return nil, fmt.Errorf("unknown servers pool %s", v)
+		}
+		return c.servers(pool)
+	case map[string]interface{}:
+		// order of servers must not depend on map order
+		for _, addr := range sortedKeys(v) {
+			settings := v[addr]
+			srv := make(map[string]interface{})
+			if settings != nil {
+				m, ok := settings.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("invalid server %s settings", addr)
+				}
+				for k, v := range m {
+					srv[k] = v
+				}
+			}
+			normalize(srv, false)
+			srv["addr"] = addr
+			res = append(res, srv)
+		}
+	case []interface{}:
+		for _, el := range v {
+			if m, ok := el.(map[string]interface{}); ok && m["addr"] != nil {
+				normalize(m, false)
+				res = append(res, m)
+				continue
+			}
+			srvs, err := c.servers(el)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, srvs...)
+		}
+	default:
+		return nil, fmt.Errorf("invalid server %v", v)
+	}
+	return res, nil
+}
+
+//	Return filter as list of ip filters in handler file format
+//	Every filter key is source address or reference to address pool,
+//	value is servers where requests from this source are sent
+//
+func (c *Config) filter(name string) ([]interface{}, error) {
+	filter, ok := c.Filters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown filter $%s", name)
+	}
+	res := make([]interface{}, 0)
+	// first matching ip filter is used and filters are named by index,
+	// so order must be same on every load
+	for _, source := range sortedKeys(filter) {
+		servers := filter[source]
+		addrs, err := c.addrs(source)
+		if err != nil {
+			return nil, err
+		}
+		srvs, err := c.servers(servers)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, map[string]interface{}{
+			"source":  addrs,
+			"servers": srvs,
+		})
+	}
+	return res, nil
+}
+
+//	Return keys of map in sorted order
+//
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//	Call f for every element of config section
+//	f returns false if element has invalid type
+//
+func section(src *Source, key string, v interface{}, f func(name string, v interface{}) bool) ErrorList {
+	if v == nil {
+		return nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return ErrorList{src.errorf(key, "expected a map")}
+	}
+	var errs ErrorList
+	for name, el := range m {
+		if !f(name, el) {
+			errs = append(errs, src.errorf(index(key, name), "invalid type"))
+		}
+	}
+	return errs
+}
+
+func toStrings(arr []interface{}) []string {
+	res := make([]string, 0, len(arr))
+	for _, v := range arr {
+		res = append(res, fmt.Sprint(v))
+	}
+	return res
+}
+
+func (l ErrorList) orNil() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+//	Make all keys lower case
+//	Names of sites, paths and elements of main config sections keep they case
+//
+func normalize(m map[string]interface{}, keepCase bool) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		v := m[k]
+		key := k
+		if !keepCase && !strings.Contains(k, "/") {
+			key = strings.ToLower(k)
+		}
+		if key != k {
+			delete(m, k)
+			m[key] = v
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			switch key {
+			case "sites", "listenports", "serverspools", "pools":
+				normalize(v, true)
+			case "filters":
+				// filter keys are sources and can be references
+				normalize(v, true)
+				for _, el := range v {
+					if el, ok := el.(map[string]interface{}); ok {
+						normalize(el, true)
+					}
+				}
+			default:
+				normalize(v, false)
+			}
+		case []interface{}:
+			for _, el := range v {
+				if el, ok := el.(map[string]interface{}); ok {
+					normalize(el, false)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/averageNetAdmin/andproxy/internal/balancing"
+	"github.com/averageNetAdmin/andproxy/internal/client"
+	"github.com/averageNetAdmin/andproxy/internal/dns"
+	"github.com/averageNetAdmin/andproxy/internal/hashkey"
+	"github.com/averageNetAdmin/andproxy/internal/ranges"
+)
+
+// Time to wait active connections on shutdown if grace period is not set in config
+//
+const DefaultGracePeriod = 30 * time.Second
+
+// Time after which idle udp session is closed if it is not set in config
+//
+const DefaultSessionTimeout = 30 * time.Second
+
+// How often servers file is read if interval is not set in config
+//
+const DefaultServersFileInterval = 5 * time.Second
+
+// Global section of main config
+//
+type Global struct {
+	LogDir      string        `mapstructure:"logdir"`
+	GracePeriod time.Duration `mapstructure:"graceperiod"`
+	// dns server (host:port) for server host names, system resolver is used if not set
+	Resolver string `mapstructure:"resolver"`
+}
+
+// Config of tcp and udp handler
+//
+type TCPHandler struct {
+	Target         `mapstructure:",squash"`
+	LogDir         string        `mapstructure:"logdir"`
+	GracePeriod    time.Duration `mapstructure:"graceperiod"`
+	SessionTimeout time.Duration `mapstructure:"sessiontimeout"`
+	// nil means all servers of pool are tried
+	Retries        *int          `mapstructure:"retries"`
+	ConnectTimeout time.Duration `mapstructure:"connecttimeout"`
+}
+
+// Config of http and https handler
+//
+type HTTPHandler struct {
+	LogDir      string          `mapstructure:"logdir"`
+	GracePeriod time.Duration   `mapstructure:"graceperiod"`
+	Secure      bool            `mapstructure:"secure"`
+	Sites       map[string]Site `mapstructure:"sites"`
+}
+
+// Site (virtual host) of http handler
+// If servers are set, site has one path "/" with site settings
+//
+type Site struct {
+	Target         `mapstructure:",squash"`
+	Certificate    string            `mapstructure:"certificate"`
+	CertificateKey string            `mapstructure:"certificatekey"`
+	Paths          map[string]Target `mapstructure:"paths"`
+}
+
+// Where and how requests are sent
+// Used by tcp handler and by http path
+//
+type Target struct {
+	Accept         []string      `mapstructure:"accept"`
+	Deny           []string      `mapstructure:"deny"`
+	Servers        []Server      `mapstructure:"servers"`
+	MinServers     int           `mapstructure:"minservers"`
+	Balancing      string        `mapstructure:"balancing"`
+	IPFilters      []Filter      `mapstructure:"ipfilters"`
+	ToPort         int           `mapstructure:"toport"`
+	DeadLine       time.Duration `mapstructure:"deadline"`
+	ReadDeadLine   time.Duration `mapstructure:"readdeadline"`
+	WriteDeadLine  time.Duration `mapstructure:"writedeadline"`
+	MaxConnectTime time.Duration `mapstructure:"maxconnectionstime"`
+	MaxConnections int64         `mapstructure:"maxconnections"`
+	OverFlow       string        `mapstructure:"overflow"`
+	HealthCheck    *HealthCheck  `mapstructure:"healthcheck"`
+	// if not set, servers are ejected only by health checks
+	OutlierDetection *OutlierDetection `mapstructure:"outlierdetection"`
+	// template of key of http request for hash balancing, client address by default
+	HashKey     string `mapstructure:"hashkey"`
+	ServersFile `mapstructure:",squash"`
+}
+
+// Json or yaml file with servers that are added to pool
+// File is read again every interval and changes are applied to running pool
+//
+type ServersFile struct {
+	Path     string        `mapstructure:"serversfile"`
+	Interval time.Duration `mapstructure:"serversfileinterval"`
+}
+
+// Requests from source addresses are sent to servers of filter
+//
+type Filter struct {
+	Source     []string `mapstructure:"source"`
+	Servers    []Server `mapstructure:"servers"`
+	MinServers int      `mapstructure:"minservers"`
+	Balancing  string   `mapstructure:"balancing"`
+	// if not set, check and outlier detection of target are used
+	HealthCheck      *HealthCheck      `mapstructure:"healthcheck"`
+	OutlierDetection *OutlierDetection `mapstructure:"outlierdetection"`
+	ServersFile      `mapstructure:",squash"`
+}
+
+// Server or range of servers
+//
+type Server struct {
+	Addr           string        `mapstructure:"addr"`
+	Weight         int           `mapstructure:"weight"`
+	MaxConnections int64         `mapstructure:"maxconnections"`
+	DeadLine       time.Duration `mapstructure:"deadline"`
+	ReadDeadLine   time.Duration `mapstructure:"readdeadline"`
+	WriteDeadLine  time.Duration `mapstructure:"writedeadline"`
+	MaxConnectTime time.Duration `mapstructure:"maxconnectionstime"`
+	SlowStart      time.Duration `mapstructure:"slowstart"`
+	Priority       int           `mapstructure:"priority"`
+	Backup         bool          `mapstructure:"backup"`
+	// how often host name is resolved again
+	ResolveInterval time.Duration `mapstructure:"resolveinterval"`
+	// circuit breaker is opened when maxfails failures happen in failwindow,
+	// after breaktime halfopenrequests trial requests are sent to server
+	MaxFails         int           `mapstructure:"maxfails"`
+	FailWindow       time.Duration `mapstructure:"failwindow"`
+	BreakTime        time.Duration `mapstructure:"breaktime"`
+	HalfOpenRequests int           `mapstructure:"halfopenrequests"`
+}
+
+// Active check of pool servers
+// Type is tcp (connect only), http or script
+//
+type HealthCheck struct {
+	Type     string        `mapstructure:"type"`
+	Port     int           `mapstructure:"port"`
+	Interval time.Duration `mapstructure:"interval"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	// successful checks in a row that make server healthy
+	Rise int `mapstructure:"rise"`
+	// failed checks in a row that make server unhealthy
+	Fall int `mapstructure:"fall"`
+	// http check, body is regular expression
+	Path   string `mapstructure:"path"`
+	Host   string `mapstructure:"host"`
+	Status int    `mapstructure:"status"`
+	Body   string `mapstructure:"body"`
+	// script check
+	Script []Step `mapstructure:"script"`
+}
+
+// Passive check of pool servers by results of client connections and requests
+// Server is ejected from pool when it fails consecutiveerrors times in a row or when
+// errorrate percent of its minrequests or more requests in interval fail
+// Ejection time is doubled on every ejection in a row up to maxejectiontime,
+// no more than maxejectionpercent percent of servers of pool are ejected at once
+//
+type OutlierDetection struct {
+	ConsecutiveErrors  int           `mapstructure:"consecutiveerrors"`
+	ErrorRate          int           `mapstructure:"errorrate"`
+	MinRequests        int           `mapstructure:"minrequests"`
+	Interval           time.Duration `mapstructure:"interval"`
+	EjectionTime       time.Duration `mapstructure:"ejectiontime"`
+	MaxEjectionTime    time.Duration `mapstructure:"maxejectiontime"`
+	MaxEjectionPercent int           `mapstructure:"maxejectionpercent"`
+}
+
+// Step of script check
+// Send data to server or read from server until expected data received
+//
+type Step struct {
+	Send   string `mapstructure:"send"`
+	Expect string `mapstructure:"expect"`
+}
+
+//	Check values that can not be checked by types
+//
+func (g *Global) validate(src *Source) ErrorList {
+	var errs ErrorList
+	if g.GracePeriod < 0 {
+		errs = append(errs, src.errorf("graceperiod", "must not be negative"))
+	}
+	if g.Resolver != "" {
+		_, _, err := net.SplitHostPort(g.Resolver)
+		if err != nil {
+			errs = append(errs, src.errorf("resolver", "%v", err))
+		}
+	}
+	return errs
+}
+
+//	Check values that can not be checked by types
+//
+func (h *TCPHandler) validate(src *Source) ErrorList {
+	errs := h.Target.validate(src, "")
+	if h.GracePeriod < 0 {
+		errs = append(errs, src.errorf("graceperiod", "must not be negative"))
+	}
+	if h.SessionTimeout < 0 {
+		errs = append(errs, src.errorf("sessiontimeout", "must not be negative"))
+	}
+	if h.Retries != nil && *h.Retries < 0 {
+		errs = append(errs, src.errorf("retries", "must not be negative"))
+	}
+	if h.ConnectTimeout < 0 {
+		errs = append(errs, src.errorf("connecttimeout", "must not be negative"))
+	}
+	if h.HashKey != "" {
+		errs = append(errs, src.errorf("hashkey", "is used only by http handlers"))
+	}
+	// handler without servers or port can't proxy any connection
+	if len(h.Servers) == 0 && h.ServersFile.Path == "" {
+		errs = append(errs, src.errorf("servers", "no servers or serversfile"))
+	}
+	for i, filter := range h.IPFilters {
+		if len(filter.Servers) == 0 && filter.ServersFile.Path == "" {
+			errs = append(errs, src.errorf(index("ipfilters", fmt.Sprint(i)), "no servers or serversfile"))
+		}
+	}
+	if h.ToPort == 0 {
+		errs = append(errs, src.errorf("toport", "must be set"))
+	}
+	return errs
+}
+
+//	Check values that can not be checked by types
+//
+func (h *HTTPHandler) validate(src *Source) ErrorList {
+	var errs ErrorList
+	if len(h.Sites) == 0 {
+		errs = append(errs, src.errorf("sites", "no sites avaible"))
+	}
+	if h.GracePeriod < 0 {
+		errs = append(errs, src.errorf("graceperiod", "must not be negative"))
+	}
+	for name, site := range h.Sites {
+		errs = append(errs, site.validate(src, index("sites", name), name)...)
+	}
+	return errs
+}
+
+func (s *Site) validate(src *Source, key, domainName string) ErrorList {
+	var errs ErrorList
+	if domainName != "*" {
+		_, err := regexp.Compile(domainName)
+		if err != nil {
+			errs = append(errs, src.errorf(key, "invalid domain name: %v", err))
+		}
+	}
+	if (s.Certificate == "") != (s.CertificateKey == "") {
+		errs = append(errs, src.errorf(key, "certificate and certificatekey must be set together"))
+	}
+	if len(s.Servers) != 0 || s.ServersFile.Path != "" {
+		errs = append(errs, s.Target.validate(src, key)...)
+		// servers of site get all requests, so paths would not be used
+		if len(s.Paths) != 0 {
+			errs = append(errs, src.errorf(field(key, "paths"), "site %s has servers and paths, only one of they can be set", domainName))
+		}
+	} else if len(s.Paths) == 0 {
+		errs = append(errs, src.errorf(key, "no servers or paths"))
+	}
+	for path, target := range s.Paths {
+		pathKey := index(field(key, "paths"), path)
+		_, err := regexp.Compile(path)
+		if err != nil {
+			errs = append(errs, src.errorf(pathKey, "invalid path: %v", err))
+		}
+		errs = append(errs, target.validate(src, pathKey)...)
+	}
+	return errs
+}
+
+func (t *Target) validate(src *Source, key string) ErrorList {
+	var errs ErrorList
+	errs = append(errs, validateAddrs(src, field(key, "accept"), t.Accept)...)
+	errs = append(errs, validateAddrs(src, field(key, "deny"), t.Deny)...)
+	errs = append(errs, validateServers(src, field(key, "servers"), t.Servers)...)
+	errs = append(errs, validateBalancing(src, field(key, "balancing"), t.Balancing)...)
+	for i, filter := range t.IPFilters {
+		filterKey := index(field(key, "ipfilters"), fmt.Sprint(i))
+		errs = append(errs, validateAddrs(src, field(filterKey, "source"), filter.Source)...)
+		errs = append(errs, validateServers(src, field(filterKey, "servers"), filter.Servers)...)
+		errs = append(errs, validateBalancing(src, field(filterKey, "balancing"), filter.Balancing)...)
+		if filter.MinServers < 0 {
+			errs = append(errs, src.errorf(field(filterKey, "minservers"), "must not be negative"))
+		}
+		if filter.HealthCheck != nil {
+			errs = append(errs, filter.HealthCheck.validate(src, field(filterKey, "healthcheck"))...)
+		}
+		if filter.OutlierDetection != nil {
+			errs = append(errs, filter.OutlierDetection.validate(src, field(filterKey, "outlierdetection"))...)
+		}
+		errs = append(errs, filter.ServersFile.validate(src, filterKey)...)
+	}
+	errs = append(errs, t.ServersFile.validate(src, key)...)
+	if t.HealthCheck != nil {
+		errs = append(errs, t.HealthCheck.validate(src, field(key, "healthcheck"))...)
+	}
+	if t.OutlierDetection != nil {
+		errs = append(errs, t.OutlierDetection.validate(src, field(key, "outlierdetection"))...)
+	}
+	if t.HashKey != "" {
+		if _, err := hashkey.Parse(t.HashKey); err != nil {
+			errs = append(errs, src.errorf(field(key, "hashkey"), "%v", err))
+		}
+	}
+	if t.ToPort < 0 || t.ToPort > 65535 {
+		errs = append(errs, src.errorf(field(key, "toport"), "invalid port %d", t.ToPort))
+	}
+	if t.MaxConnections < 0 {
+		errs = append(errs, src.errorf(field(key, "maxconnections"), "must not be negative"))
+	}
+	if t.MinServers < 0 {
+		errs = append(errs, src.errorf(field(key, "minservers"), "must not be negative"))
+	}
+	switch t.OverFlow {
+	case "", "wait", "reject":
+	default:
+		errs = append(errs, src.errorf(field(key, "overflow"), "must be wait or reject, got %s", t.OverFlow))
+	}
+	return errs
+}
+
+//	Check that servers file can be read and its servers are valid
+//
+func (f *ServersFile) validate(src *Source, key string) ErrorList {
+	var errs ErrorList
+	if f.Interval < 0 {
+		errs = append(errs, src.errorf(field(key, "serversfileinterval"), "must not be negative"))
+	}
+	if f.Path == "" {
+		return errs
+	}
+	_, err := LoadServers(f.Path)
+	if err != nil {
+		errs = append(errs, src.errorf(field(key, "serversfile"), "%v", err))
+	}
+	return errs
+}
+
+func (s *Server) validate(src *Source, key string) ErrorList {
+	var errs ErrorList
+	if s.Addr == "" {
+		errs = append(errs, src.errorf(field(key, "addr"), "address is not set"))
+	} else if !dns.IsHostname(s.Addr) {
+		addrs, err := ranges.Create(s.Addr)
+		if err != nil {
+			errs = append(errs, src.errorf(field(key, "addr"), "%v", err))
+		}
+		for _, addr := range addrs {
+			if net.ParseIP(addr) == nil {
+				errs = append(errs, src.errorf(field(key, "addr"), "invalid address %s", addr))
+				break
+			}
+		}
+	}
+	if s.Weight < 0 {
+		errs = append(errs, src.errorf(field(key, "weight"), "must not be negative"))
+	}
+	if s.MaxFails < 0 {
+		errs = append(errs, src.errorf(field(key, "maxfails"), "must not be negative"))
+	}
+	if s.ResolveInterval < 0 {
+		errs = append(errs, src.errorf(field(key, "resolveinterval"), "must not be negative"))
+	}
+	if s.Priority < 0 {
+		errs = append(errs, src.errorf(field(key, "priority"), "must not be negative"))
+	}
+	if s.SlowStart < 0 {
+		errs = append(errs, src.errorf(field(key, "slowstart"), "must not be negative"))
+	}
+	if s.FailWindow < 0 {
+		errs = append(errs, src.errorf(field(key, "failwindow"), "must not be negative"))
+	}
+	if s.BreakTime < 0 {
+		errs = append(errs, src.errorf(field(key, "breaktime"), "must not be negative"))
+	}
+	if s.HalfOpenRequests < 0 {
+		errs = append(errs, src.errorf(field(key, "halfopenrequests"), "must not be negative"))
+	}
+	if s.MaxConnections < 0 {
+		errs = append(errs, src.errorf(field(key, "maxconnections"), "must not be negative"))
+	}
+	return errs
+}
+
+func (h *HealthCheck) validate(src *Source, key string) ErrorList {
+	var errs ErrorList
+	switch h.Type {
+	case "", "tcp", "script":
+	case "http":
+		if h.Body != "" {
+			_, err := regexp.Compile(h.Body)
+			if err != nil {
+				errs = append(errs, src.errorf(field(key, "body"), "invalid regular expression: %v", err))
+			}
+		}
+		if h.Status != 0 && (h.Status < 100 || h.Status > 599) {
+			errs = append(errs, src.errorf(field(key, "status"), "invalid http status %d", h.Status))
+		}
+		if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+			errs = append(errs, src.errorf(field(key, "path"), "must start with /"))
+		}
+	default:
+		errs = append(errs, src.errorf(field(key, "type"), "must be tcp, http or script, got %s", h.Type))
+	}
+	if h.Type != "http" && (h.Path != "" || h.Host != "" || h.Status != 0 || h.Body != "") {
+		errs = append(errs, src.errorf(key, "path, host, status and body are used only by http check"))
+	}
+	if h.Type == "script" && len(h.Script) == 0 {
+		errs = append(errs, src.errorf(field(key, "script"), "no steps"))
+	} else if h.Type != "script" && len(h.Script) != 0 {
+		errs = append(errs, src.errorf(field(key, "script"), "is used only by script check"))
+	}
+	for i, step := range h.Script {
+		if (step.Send == "") == (step.Expect == "") {
+			errs = append(errs, src.errorf(index(field(key, "script"), fmt.Sprint(i)), "step must have send or expect"))
+		}
+	}
+	if h.Port < 0 || h.Port > 65535 {
+		errs = append(errs, src.errorf(field(key, "port"), "invalid port %d", h.Port))
+	}
+	if h.Interval < 0 {
+		errs = append(errs, src.errorf(field(key, "interval"), "must not be negative"))
+	}
+	if h.Timeout < 0 {
+		errs = append(errs, src.errorf(field(key, "timeout"), "must not be negative"))
+	}
+	if h.Interval != 0 && h.Timeout > h.Interval {
+		errs = append(errs, src.errorf(field(key, "timeout"), "must not be greater than interval"))
+	}
+	if h.Rise < 0 {
+		errs = append(errs, src.errorf(field(key, "rise"), "must not be negative"))
+	}
+	if h.Fall < 0 {
+		errs = append(errs, src.errorf(field(key, "fall"), "must not be negative"))
+	}
+	return errs
+}
+
+func (o *OutlierDetection) validate(src *Source, key string) ErrorList {
+	var errs ErrorList
+	if o.ConsecutiveErrors < 0 {
+		errs = append(errs, src.errorf(field(key, "consecutiveerrors"), "must not be negative"))
+	}
+	if o.ErrorRate < 0 || o.ErrorRate > 100 {
+		errs = append(errs, src.errorf(field(key, "errorrate"), "must be from 0 to 100, got %d", o.ErrorRate))
+	}
+	if o.MinRequests < 0 {
+		errs = append(errs, src.errorf(field(key, "minrequests"), "must not be negative"))
+	}
+	if o.Interval < 0 {
+		errs = append(errs, src.errorf(field(key, "interval"), "must not be negative"))
+	}
+	if o.EjectionTime < 0 {
+		errs = append(errs, src.errorf(field(key, "ejectiontime"), "must not be negative"))
+	}
+	if o.MaxEjectionTime < 0 {
+		errs = append(errs, src.errorf(field(key, "maxejectiontime"), "must not be negative"))
+	}
+	if o.MaxEjectionTime != 0 && o.MaxEjectionTime < o.EjectionTime {
+		errs = append(errs, src.errorf(field(key, "maxejectiontime"), "must not be less than ejectiontime"))
+	}
+	if o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		errs = append(errs, src.errorf(field(key, "maxejectionpercent"), "must be from 0 to 100, got %d", o.MaxEjectionPercent))
+	}
+	return errs
+}
+
+func validateServers(src *Source, key string, servers []Server) ErrorList {
+	var errs ErrorList
+	for i := range servers {
+		errs = append(errs, servers[i].validate(src, index(key, fmt.Sprint(i)))...)
+	}
+	return errs
+}
+
+func validateAddrs(src *Source, key string, addrs []string) ErrorList {
+	var errs ErrorList
+	for i, addr := range addrs {
+		_, err := client.New(addr)
+		if err != nil {
+			errs = append(errs, src.errorf(index(key, fmt.Sprint(i)), "invalid address %s: %v", addr, err))
+		}
+	}
+	return errs
+}
+
+func validateBalancing(src *Source, key, name string) ErrorList {
+	if name == "" {
+		return nil
+	}
+	_, err := balancing.NewMethod(strings.ToLower(name))
+	if err != nil {
+		return ErrorList{src.errorf(key, "%v", err)}
+	}
+	return nil
+}
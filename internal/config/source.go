@@ -0,0 +1,267 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"gopkg.in/yaml.v3"
+)
+
+// Error in config with place where it was found
+//
+type Error struct {
+	File string
+	Line int
+	Key  string
+	Err  string
+}
+
+func (e *Error) Error() string {
+	place := e.File
+	if e.Line != 0 {
+		place = fmt.Sprintf("%s:%d", place, e.Line)
+	}
+	if e.Key != "" {
+		place = fmt.Sprintf("%s: %s", place, e.Key)
+	}
+	return fmt.Sprintf("%s: %s", place, e.Err)
+}
+
+// All errors found in config
+//
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// File that config was read from
+// Used to find line of config key to report errors
+//
+type Source struct {
+	File   string
+	prefix string
+	lines  map[string]int
+}
+
+//	Parse yaml to node tree and remember lines of all keys
+//
+func newSource(file string, data []byte) (*Source, *yaml.Node, error) {
+	root := new(yaml.Node)
+	err := yaml.Unmarshal(data, root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", file, err)
+	}
+	src := &Source{
+		File:  file,
+		lines: make(map[string]int),
+	}
+	src.index(root, nil)
+	return src, root, nil
+}
+
+//	Return source of part of config under key
+//	Keys of errors reported by returned source are relative to that part
+//
+func (s *Source) Sub(key string) *Source {
+	if s == nil {
+		return nil
+	}
+	return &Source{
+		File:   s.File,
+		prefix: field(s.prefix, key),
+		lines:  s.lines,
+	}
+}
+
+//	Create error for key
+//
+func (s *Source) errorf(key string, format string, args ...interface{}) *Error {
+	if s == nil {
+		return &Error{Key: key, Err: fmt.Sprintf(format, args...)}
+	}
+	fullKey := s.prefix
+	if key != "" {
+		fullKey = field(s.prefix, key)
+	}
+	return &Error{
+		File: s.File,
+		Line: s.line(key),
+		Key:  fullKey,
+		Err:  fmt.Sprintf(format, args...),
+	}
+}
+
+//	Find line of key. If key is not in file (it was added by reference)
+//	line of nearest parent key is returned
+//
+func (s *Source) line(key string) int {
+	path := append(splitKey(s.prefix), splitKey(key)...)
+	for i := len(path); i > 0; i-- {
+		if line, ok := s.lines[lineKey(path[:i])]; ok {
+			return line
+		}
+	}
+	return 0
+}
+
+func (s *Source) index(n *yaml.Node, path []string) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			s.index(c, path)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i]
+			p := append(append([]string{}, path...), k.Value)
+			s.lines[lineKey(p)] = k.Line
+			s.index(n.Content[i+1], p)
+			// site paths are moved under paths key before decoding
+			if strings.Contains(k.Value, "/") {
+				p := append(append([]string{}, path...), "paths", k.Value)
+				s.lines[lineKey(p)] = k.Line
+				s.index(n.Content[i+1], p)
+			}
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			p := append(append([]string{}, path...), strconv.Itoa(i))
+			s.lines[lineKey(p)] = c.Line
+			s.index(c, p)
+		}
+	}
+}
+
+func lineKey(path []string) string {
+	return strings.ToLower(strings.Join(path, "\x00"))
+}
+
+//	Split key in format a.b[c].d to parts
+//
+func splitKey(key string) []string {
+	var parts []string
+	cur := new(strings.Builder)
+	flush := func() {
+		if cur.Len() > 0 {
+			parts = append(parts, cur.String())
+			cur.Reset()
+		}
+	}
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '.':
+			flush()
+		case '[':
+			end := strings.IndexByte(key[i+1:], ']')
+			if end == -1 {
+				cur.WriteString(key[i:])
+				i = len(key)
+				continue
+			}
+			flush()
+			parts = append(parts, key[i+1:i+1+end])
+			i += end + 1
+		default:
+			cur.WriteByte(key[i])
+		}
+	}
+	flush()
+	return parts
+}
+
+//	Key of struct field
+//
+func field(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+//	Key of map element or array element
+//
+func index(parent, name string) string {
+	return parent + "[" + name + "]"
+}
+
+//	Decode config map to struct
+//	Unknown keys and values of wrong type are errors
+//
+func decode(input interface{}, output interface{}, src *Source) ErrorList {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:  durationHook,
+		ErrorUnused: true,
+		Result:      output,
+	})
+	if err != nil {
+		return ErrorList{src.errorf("", "%v", err)}
+	}
+	err = decoder.Decode(input)
+	if err == nil {
+		return nil
+	}
+	merr, ok := err.(*mapstructure.Error)
+	if !ok {
+		return ErrorList{src.errorf("", "%v", err)}
+	}
+	var errs ErrorList
+	for _, msg := range merr.Errors {
+		errs = append(errs, decodeError(src, msg)...)
+	}
+	return errs
+}
+
+//	Convert mapstructure error message to errors with key
+//
+func decodeError(src *Source, msg string) ErrorList {
+	start := strings.IndexByte(msg, '\'')
+	end := -1
+	if start != -1 {
+		end = strings.IndexByte(msg[start+1:], '\'')
+	}
+	if end == -1 {
+		return ErrorList{src.errorf("", "%s", msg)}
+	}
+	key := msg[start+1 : start+1+end]
+	rest := strings.TrimSpace(msg[:start] + msg[start+1+end+1:])
+
+	if strings.HasPrefix(rest, "has invalid keys: ") {
+		var errs ErrorList
+		for _, k := range strings.Split(strings.TrimPrefix(rest, "has invalid keys: "), ", ") {
+			errs = append(errs, src.errorf(field(key, k), "unknown key"))
+		}
+		return errs
+	}
+	if strings.HasPrefix(rest, "error decoding :") {
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, "error decoding :"))
+	}
+	return ErrorList{src.errorf(key, "%s", rest)}
+}
+
+//	Durations can be set as string like 1m30s or as number of seconds
+//
+func durationHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(time.Duration(0)) {
+		return data, nil
+	}
+	switch v := data.(type) {
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %s", v)
+		}
+		return d, nil
+	case int:
+		return time.Duration(v) * time.Second, nil
+	}
+	return data, nil
+}
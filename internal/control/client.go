@@ -0,0 +1,95 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/averageNetAdmin/andproxy/internal/event"
+)
+
+// Connection to control socket
+// Requests are sent one by one, client must not be used from many gorutines
+//
+type Client struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+//	Connect to control socket
+//
+func Dial(socketPath string) (*Client, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		conn: conn,
+		dec:  json.NewDecoder(bufio.NewReader(conn)),
+		enc:  json.NewEncoder(conn),
+	}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+//	Send request and decode response data to data
+//	data can be nil if response data is not needed
+//	If server replies with error it is returned
+//
+func (c *Client) Do(req Request, data interface{}) error {
+	req.Version = Version
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		return err
+	}
+	if data == nil || len(resp.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Data, data)
+}
+
+//	Subscribe to events and call f for every event until f or connection returns error
+//
+func (c *Client) Events(f func(e event.Event) error) error {
+	_, err := c.roundTrip(Request{Version: Version, Command: CmdEvents})
+	if err != nil {
+		return err
+	}
+	for {
+		var resp Response
+		err := c.dec.Decode(&resp)
+		if err != nil {
+			return err
+		}
+		var e event.Event
+		err = json.Unmarshal(resp.Data, &e)
+		if err != nil {
+			return err
+		}
+		err = f(e)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) roundTrip(req Request) (*Response, error) {
+	err := c.enc.Encode(req)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(Response)
+	err = c.dec.Decode(resp)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %v", err)
+	}
+	if !resp.OK {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,84 @@
+package control
+
+import (
+	"encoding/json"
+)
+
+// Version of control protocol
+// Requests with other version are rejected
+//
+const Version = 1
+
+// Default path of control socket
+//
+const SocketPath = "/run/andproxy.sock"
+
+// Commands
+//
+const (
+	// status of all handlers or of one handler, data is []status.Handler
+	CmdHandlers = "handlers"
+	// flat list of servers of all handlers or of one handler, data is []status.Server
+	CmdServers = "servers"
+	// enable server in one or all handlers, data is ServerResult
+	CmdEnable = "enable"
+	// stop sending new connections to server in one or all handlers, data is ServerResult
+	CmdDisable = "disable"
+	// disable server and report connections that remain, data is ServerResult
+	CmdDrain = "drain"
+	// no new connections and no health checks until server is enabled, data is ServerResult
+	CmdMaintenance = "maintenance"
+	// set weight of server in one or all handlers, data is ServerResult
+	CmdWeight = "weight"
+	// add server to pool of handler, data is ServerResult
+	CmdAddServer = "add-server"
+	// remove server from one or all pools, its connections are drained, data is ServerResult
+	CmdRemoveServer = "remove-server"
+	// add addresses to accept or deny list of handler, data is empty
+	CmdAddSources = "add-sources"
+	// remove addresses from accept or deny list of handler, data is empty
+	CmdRemoveSources = "remove-sources"
+	// reread configs like on SIGHUP, data is ReloadResult
+	CmdReload = "reload"
+	// stream events until client closes connection, data of every response is event.Event
+	CmdEvents = "events"
+)
+
+// Request is one line of json sent by client
+// Handler, Pool, Server, Weight, List and Addrs are used only by commands that need they
+//
+type Request struct {
+	Version int      `json:"version"`
+	Command string   `json:"command"`
+	Handler string   `json:"handler,omitempty"`
+	Pool    string   `json:"pool,omitempty"`
+	Server  string   `json:"server,omitempty"`
+	Weight  int      `json:"weight,omitempty"`
+	List    string   `json:"list,omitempty"`
+	Addrs   []string `json:"addrs,omitempty"`
+}
+
+// Response is one line of json sent by server for every request
+// If OK is false Error contains reason and Data is empty
+//
+type Response struct {
+	Version int             `json:"version"`
+	OK      bool            `json:"ok"`
+	Error   string          `json:"error,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Result of commands that change servers
+// Active is number of connections that remain on servers with the address, including removed servers
+//
+type ServerResult struct {
+	Changed int   `json:"changed"`
+	Active  int64 `json:"active"`
+}
+
+// Result of reload command
+// Handlers that can not be reloaded keep old config, they errors are returned by name
+//
+type ReloadResult struct {
+	Errors map[string]string `json:"errors,omitempty"`
+}
@@ -0,0 +1,265 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/averageNetAdmin/andproxy/internal/event"
+	"github.com/averageNetAdmin/andproxy/internal/status"
+)
+
+// Max length of one request line
+//
+const maxRequestSize = 1 << 20
+
+// Events that can wait for slow client, newer events are dropped
+//
+const eventsBuffer = 256
+
+// What control server can do with proxy
+//
+type Backend interface {
+	// status of all running handlers sorted by name
+	Handlers() []status.Handler
+	// enable or disable server in handler, in all handlers if handler is empty
+	SetServerEnabled(handler, addr string, enabled bool) (int, error)
+	// put server in maintenance in handler, in all handlers if handler is empty
+	SetServerMaintenance(handler, addr string) (int, error)
+	// set weight of server in handler, in all handlers if handler is empty
+	SetServerWeight(handler, addr string, weight int) (int, error)
+	// add server to pool of handler, pool can be empty if handler has one pool
+	AddServer(handler, pool, addr string, weight int) (int, error)
+	// remove server from pool of handler, from all pools and handlers if they are empty
+	RemoveServer(handler, pool, addr string) (int, error)
+	// add addresses to accept or deny list of handler or remove they from list
+	UpdateSources(handler, list string, addrs []string, remove bool) error
+	// reread configs, return errors of handlers that keep old config
+	Reload() (map[string]error, error)
+}
+
+//	Serve clients of listener until it is closed
+//	Every client is served in own gorutine
+//
+func Serve(l net.Listener, b Backend) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Println(err)
+			continue
+		}
+		go serveConn(conn, b)
+	}
+}
+
+//	Read requests line by line and write one response line for every request
+//
+func serveConn(conn net.Conn, b Backend) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxRequestSize)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var req Request
+		err := json.Unmarshal(scanner.Bytes(), &req)
+		if err != nil {
+			err = fmt.Errorf("invalid request: %v", err)
+		} else if req.Version != Version {
+			err = fmt.Errorf("unsupported protocol version %d, server supports %d", req.Version, Version)
+		}
+		if err != nil {
+			if enc.Encode(errorResponse(err)) != nil {
+				return
+			}
+			continue
+		}
+		if req.Command == CmdEvents {
+			streamEvents(conn, enc)
+			return
+		}
+		data, err := handle(req, b)
+		var resp Response
+		if err != nil {
+			resp = errorResponse(err)
+		} else {
+			resp, err = dataResponse(data)
+			if err != nil {
+				resp = errorResponse(err)
+			}
+		}
+		if enc.Encode(resp) != nil {
+			return
+		}
+	}
+	// rest of too long line can't be read, so client gets error and connection is closed
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		enc.Encode(errorResponse(fmt.Errorf("request is longer than %d bytes", maxRequestSize)))
+	}
+}
+
+//	Run command and return data of response
+//
+func handle(req Request, b Backend) (interface{}, error) {
+	switch req.Command {
+	case CmdHandlers:
+		return handlers(req, b)
+	case CmdServers:
+		hs, err := handlers(req, b)
+		if err != nil {
+			return nil, err
+		}
+		srvs := make([]status.Server, 0)
+		for i := range hs {
+			srvs = append(srvs, hs[i].Servers()...)
+		}
+		return srvs, nil
+	case CmdEnable, CmdDisable, CmdDrain, CmdMaintenance, CmdWeight, CmdAddServer, CmdRemoveServer:
+		if req.Server == "" {
+			return nil, fmt.Errorf("server is not set")
+		}
+		n, err := changeServer(req, b)
+		if err != nil {
+			return nil, err
+		}
+		return ServerResult{Changed: n, Active: active(req, b)}, nil
+	case CmdAddSources, CmdRemoveSources:
+		if req.Handler == "" {
+			return nil, fmt.Errorf("handler is not set")
+		}
+		if len(req.Addrs) == 0 {
+			return nil, fmt.Errorf("addresses are not set")
+		}
+		return nil, b.UpdateSources(req.Handler, req.List, req.Addrs, req.Command == CmdRemoveSources)
+	case CmdReload:
+		errs, err := b.Reload()
+		if err != nil {
+			return nil, err
+		}
+		res := ReloadResult{}
+		if len(errs) != 0 {
+			res.Errors = make(map[string]string, len(errs))
+			for name, err := range errs {
+				res.Errors[name] = err.Error()
+			}
+		}
+		return res, nil
+	case "":
+		return nil, fmt.Errorf("command is not set")
+	}
+	return nil, fmt.Errorf("unknown command %s", req.Command)
+}
+
+//	Run command that changes server and return number of changed servers
+//
+func changeServer(req Request, b Backend) (int, error) {
+	switch req.Command {
+	case CmdMaintenance:
+		return b.SetServerMaintenance(req.Handler, req.Server)
+	case CmdWeight:
+		if req.Weight < 1 {
+			return 0, fmt.Errorf("weight must be positive")
+		}
+		return b.SetServerWeight(req.Handler, req.Server, req.Weight)
+	case CmdAddServer:
+		if req.Handler == "" {
+			return 0, fmt.Errorf("handler is not set")
+		}
+		if req.Weight < 0 {
+			return 0, fmt.Errorf("weight must not be negative")
+		}
+		return b.AddServer(req.Handler, req.Pool, req.Server, req.Weight)
+	case CmdRemoveServer:
+		return b.RemoveServer(req.Handler, req.Pool, req.Server)
+	default:
+		return b.SetServerEnabled(req.Handler, req.Server, req.Command == CmdEnable)
+	}
+}
+
+//	Return number of active connections of servers from request
+//
+func active(req Request, b Backend) int64 {
+	hs, err := handlers(req, b)
+	if err != nil {
+		return 0
+	}
+	var n int64
+	for i := range hs {
+		for _, srv := range hs[i].Servers() {
+			if srv.Addr == req.Server {
+				n += srv.Active
+			}
+		}
+	}
+	return n
+}
+
+//	Return status of all handlers or only of handler from request
+//
+func handlers(req Request, b Backend) ([]status.Handler, error) {
+	hs := b.Handlers()
+	if req.Handler == "" {
+		return hs, nil
+	}
+	for _, h := range hs {
+		if h.Name == req.Handler {
+			return []status.Handler{h}, nil
+		}
+	}
+	return nil, fmt.Errorf("handler %s not found", req.Handler)
+}
+
+//	Send events to client until it closes connection
+//	First response has no data and confirms subscription
+//
+func streamEvents(conn net.Conn, enc *json.Encoder) {
+	events, cancel := event.Subscribe(eventsBuffer)
+	defer cancel()
+	if enc.Encode(Response{Version: Version, OK: true}) != nil {
+		return
+	}
+	// client does not send anything after subscription, read only to know when it goes away
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	for {
+		select {
+		case e := <-events:
+			resp, err := dataResponse(e)
+			if err != nil {
+				continue
+			}
+			if enc.Encode(resp) != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func dataResponse(data interface{}) (Response, error) {
+	if data == nil {
+		return Response{Version: Version, OK: true}, nil
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{Version: Version, OK: true, Data: raw}, nil
+}
+
+func errorResponse(err error) Response {
+	return Response{Version: Version, Error: err.Error()}
+}
@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/averageNetAdmin/andproxy/internal/ranges"
+)
+
+// How often host names of servers are resolved again if interval is not set in config
+//
+const DefaultInterval = 30 * time.Second
+
+// Max time of one lookup
+//
+const lookupTimeout = 5 * time.Second
+
+// Resolver of host names
+// *net.Resolver implements it, so system resolver or any dns server can be used
+//
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Resolver with fixed answers
+// Can be used instead of dns server in tests and local setups
+//
+type Static map[string][]string
+
+func (s Static) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, ok := s[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+var (
+	mu       sync.RWMutex
+	resolver Resolver = net.DefaultResolver
+)
+
+//	Return resolver that is used for server host names
+//
+func Default() Resolver {
+	mu.RLock()
+	defer mu.RUnlock()
+	return resolver
+}
+
+//	Set resolver that is used for server host names
+//
+func SetDefault(r Resolver) {
+	mu.Lock()
+	defer mu.Unlock()
+	resolver = r
+}
+
+//	Return resolver that sends queries to dns server on addr (host:port)
+//	If addr is empty system resolver is returned
+//
+func NewResolver(addr string) Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	}
+}
+
+var hostname = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.?$`)
+
+//	Return true if addr is host name, not ip address or range of addresses
+//
+func IsHostname(addr string) bool {
+	return net.ParseIP(addr) == nil && !strings.Contains(addr, "[") && hostname.MatchString(addr)
+}
+
+//	Resolve host to sorted list of unique ip addresses
+//
+func Lookup(ctx context.Context, r Resolver, host string) ([]string, error) {
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(addrs))
+	res := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if net.ParseIP(addr) == nil || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		res = append(res, addr)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("%s has no addresses", host)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+//	Return ip addresses of server address
+//	Address can be ip address, range of addresses or host name that is resolved by default resolver
+//
+func Addrs(addr string) ([]string, error) {
+	if !IsHostname(addr) {
+		return ranges.Create(addr)
+	}
+	return LookupDefault(addr)
+}
+
+//	Resolve host with default resolver
+//
+func LookupDefault(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	return Lookup(ctx, Default(), host)
+}
@@ -0,0 +1,85 @@
+package event
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of events
+//
+const (
+	ServerEnabled   = "server.enabled"
+	ServerDisabled  = "server.disabled"
+	ServerBroken    = "server.broken"
+	ServerHalfOpen  = "server.halfopen"
+	ServerRestored  = "server.restored"
+	ServerHealthy   = "server.healthy"
+	ServerUnhealthy = "server.unhealthy"
+	ServerAdded     = "server.added"
+	ServerRemoved   = "server.removed"
+	ServerChanged   = "server.changed"
+	ServerMaint     = "server.maintenance"
+	ServerEjected   = "server.ejected"
+	ServerReturned  = "server.returned"
+	ResolveFailed   = "resolve.failed"
+	ServersFailed   = "serversfile.failed"
+	HandlerStarted  = "handler.started"
+	HandlerUpdated  = "handler.updated"
+	HandlerRemoved  = "handler.removed"
+	HandlerSkipped  = "handler.skipped"
+	SourcesChanged  = "handler.sources"
+	ReloadFailed    = "reload.failed"
+	ReloadCompleted = "reload.completed"
+)
+
+// Something that happened in proxy
+// Handler and Server are set if event is about they
+//
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Handler string    `json:"handler,omitempty"`
+	Server  string    `json:"server,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+var (
+	mu   sync.Mutex
+	subs = make(map[chan Event]struct{})
+)
+
+//	Send event to all subscribers
+//	Never blocks, if subscriber channel is full event is dropped for that subscriber
+//
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for ch := range subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+//	Subscribe to all events published after call
+//	Returned function must be called to unsubscribe, channel is closed after that
+//
+func Subscribe(size int) (<-chan Event, func()) {
+	ch := make(chan Event, size)
+	mu.Lock()
+	subs[ch] = struct{}{}
+	mu.Unlock()
+	once := new(sync.Once)
+	return ch, func() {
+		once.Do(func() {
+			mu.Lock()
+			delete(subs, ch)
+			mu.Unlock()
+			close(ch)
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package def
+
+import (
+	"net"
+	"sync"
+)
+
+//	Set of active connections
+//	Used to wait until all connections end and to force close they on shutdown
+//
+type connSet struct {
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	// closed when set is closed and all connections removed
+	done chan struct{}
+}
+
+func newConnSet() *connSet {
+	return &connSet{
+		conns: make(map[net.Conn]struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+//	Add connection to set
+//	Return false if set is already closed, connection must not be used in that case
+//
+func (cs *connSet) add(conn net.Conn) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		return false
+	}
+	cs.conns[conn] = struct{}{}
+	return true
+}
+
+//	Remove connections from set
+//
+func (cs *connSet) remove(conns ...net.Conn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, conn := range conns {
+		delete(cs.conns, conn)
+	}
+	if cs.closed && len(cs.conns) == 0 {
+		cs.closeDone()
+	}
+}
+
+//	Forbid adding new connections
+//	Returned channel is closed when all connections are removed
+//
+func (cs *connSet) close() <-chan struct{} {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if !cs.closed {
+		cs.closed = true
+		if len(cs.conns) == 0 {
+			cs.closeDone()
+		}
+	}
+	return cs.done
+}
+
+//	Close all connections in set
+//
+func (cs *connSet) closeAll() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for conn := range cs.conns {
+		conn.Close()
+	}
+}
+
+func (cs *connSet) closeDone() {
+	select {
+	case <-cs.done:
+	default:
+		close(cs.done)
+	}
+}
@@ -1,17 +1,25 @@
 package def
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/averageNetAdmin/andproxy/internal/backend"
+	"github.com/averageNetAdmin/andproxy/internal/breaker"
 	"github.com/averageNetAdmin/andproxy/internal/client"
-	"gopkg.in/yaml.v3"
+	"github.com/averageNetAdmin/andproxy/internal/config"
+	"github.com/averageNetAdmin/andproxy/internal/hashkey"
+	"github.com/averageNetAdmin/andproxy/internal/status"
 )
 
 // Contain all info about tcp and udp handlers
@@ -23,7 +31,20 @@ type Handler struct {
 	currentconnectionsNumber int64
 	rejected                 uint64
 	logger                   *log.Logger
+	listener                 net.Listener
+	conns                    *connSet
+	// udp handlers use packet listener and sessions instead of listener
+	packetConn net.PacketConn
+	sessions   *sessionTable
+
+	// current *Config, replaced on reload
+	// every connection use config that was current when it was accepted
+	config atomic.Value
+}
 
+// Part of handler that can be changed without rebinding listener
+//
+type Config struct {
 	Accept         *client.Sources
 	Deny           *client.Sources
 	Servers        *Pool
@@ -36,257 +57,409 @@ type Handler struct {
 	MaxConnectTime time.Duration
 	MaxConnections int64
 	OverFlow       string
+	GracePeriod    time.Duration
+	// time after which idle udp session is closed
+	SessionTimeout time.Duration
+	// how many other servers are tried if connect fails, -1 means all servers of pool
+	Retries int
+	// max time of all connect attempts, 0 means no limit
+	ConnectTimeout time.Duration
 }
 
-//	Create new handler from yaml file
+//	Create new handler from checked config
 //
-func NewHandler(configPath, protocol, port string) (*Handler, error) {
-	// read config file
-	configBytes, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		return nil, err
+func NewHandler(c *config.TCPHandler, protocol, port string) (*Handler, error) {
+	logDir := c.LogDir
+	// if not set create log in defult dir
+	if logDir == "" {
+		logDir = fmt.Sprintf("%s/%s_%s/", config.DefaultLogDir, protocol, port)
 	}
-	
-	// parse config to map
-	config := make(map[string]interface{}, 0)
-	err = yaml.Unmarshal(configBytes, config)
+
+	// parse accepted and denied clients address if field not empty
+	accept, err := client.New(c.Accept...)
 	if err != nil {
 		return nil, err
 	}
-
-	// check is log dir checked manually
-	logDir, ok := config["logdir"].(string)
-	// if not create log in defult dir
-	if !ok {
-		logDir = fmt.Sprintf("/var/log/andproxy/%s_%s/", protocol, port)
-	}
-	err = os.MkdirAll(logDir, 0644)
+	deny, err := client.New(c.Deny...)
 	if err != nil {
 		return nil, err
 	}
 
-	// parse accepted clients address if field not empty 
-	accept, err := client.New()
+	// clients can be filtered by source address and they requests sent to different servers
+	pool, filters, err := TargetFromConfig(c.Target)
 	if err != nil {
 		return nil, err
 	}
-	acceptArr, ok := config["accept"].([]interface{}) 
-	if ok {
-		for _, v := range acceptArr {
-			acc, ok := v.(string)
-			if ok {
-				err := accept.Add(acc)
-				if err != nil {
-					return nil, err
-				}
-			}
 
-		}
-		if len(acceptArr) == 0 {
+	grace := c.GracePeriod
+	if grace == 0 {
+		grace = config.DefaultGracePeriod
+	}
+	sessionTimeout := c.SessionTimeout
+	if sessionTimeout == 0 {
+		sessionTimeout = config.DefaultSessionTimeout
+	}
+	retries := -1
+	if c.Retries != nil {
+		retries = *c.Retries
+	}
 
-			accept = nil
-		}
-	} else {
-		accept = nil
+	// log file is created on Listen, so handler can be checked without side effects
+	h := &Handler{
+		Protocol: protocol,
+		Port:     port,
+		conns:    newConnSet(),
+		sessions: newSessionTable(),
 	}
+	h.config.Store(&Config{
+		Toport:         c.ToPort,
+		Accept:         accept,
+		Deny:           deny,
+		Servers:        pool,
+		IPFilter:       filters,
+		DeadLine:       c.DeadLine,
+		WriteDeadLine:  c.WriteDeadLine,
+		ReadDeadLine:   c.ReadDeadLine,
+		MaxConnectTime: c.MaxConnectTime,
+		MaxConnections: c.MaxConnections,
+		OverFlow:       c.OverFlow,
+		GracePeriod:    grace,
+		SessionTimeout: sessionTimeout,
+		Retries:        retries,
+		ConnectTimeout: c.ConnectTimeout,
+		LogPath:        fmt.Sprintf("%s/%s_%s.log", logDir, protocol, port),
+	})
+	return h, nil
 
-	// parse denied clients address if field not empty 
-	deny, err := client.New()
+}
+
+//	Create log directory and open log file
+//
+func openLog(logPath string) (*log.Logger, error) {
+	err := os.MkdirAll(filepath.Dir(logPath), 0644)
 	if err != nil {
 		return nil, err
 	}
-	denyArr, ok := config["deny"].([]interface{})
-	if ok {
-		for _, v := range denyArr {
-			den, ok := v.(string)
-			if ok {
-				err := deny.Add(den)
-				if err != nil {
-					return nil, err
-				}
-			}
-		}
-		if len(denyArr) == 0 {
-			deny = nil
-		}
-	} else {
-		deny = nil
-	}
-
-	// parse servers
-	srvs := make([]*Server, 0)
-	serversArr, ok := config["servers"].([]interface{})
-	if ok {
-		for i := 0; i < len(serversArr); i++ {
-			serversStr, ok := serversArr[i].(map[string]interface{})
-			if ok {
-				srvss, err := ServersFromMap(serversStr, logDir)
-				if err != nil {
-					return nil, err
-				}
-				srvs = append(srvs, srvss...)
-			}
-
-		}
+	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
 	}
+	logger := log.New(file, " ", log.LstdFlags)
+	logger.SetFlags(log.LstdFlags)
+	return logger, nil
+}
+
+//	Return current handler config
+//
+func (s *Handler) Config() *Config {
+	return s.config.Load().(*Config)
+}
 
-	// parse servers. if field not empty use default 
-	balancingStr, ok := config["balancing"].(string)
-	if ok {
-		balancingStr = ""
+//	Replace config with config of handler n
+//	Listener is not rebound, in-flight connections keep using old config until they close
+//
+func (s *Handler) Reload(n *Handler) error {
+	if s.Protocol != n.Protocol || s.Port != n.Port {
+		return fmt.Errorf("can not reload %s_%s handler from %s_%s", s.Protocol, s.Port, n.Protocol, n.Port)
 	}
-	pool, err := NewPool(srvs, balancingStr)
-	if err != nil {
-		return nil, err
+	// servers keep state after reload: disabled or maintenance, health, breaker and ejection
+	st := make(backend.State)
+	s.Config().eachPool(func(_ string, p *Pool) {
+		p.SaveState(st)
+	})
+	n.Config().eachPool(func(_ string, p *Pool) {
+		p.RestoreState(st)
+	})
+	if s.listener != nil || s.packetConn != nil {
+		n.Config().eachPool(func(_ string, p *Pool) {
+			p.Start()
+		})
 	}
+	old := s.config.Swap(n.Config()).(*Config)
+	old.eachPool(func(_ string, p *Pool) {
+		p.Stop()
+	})
+	return nil
+}
 
-	// read deadlines. if empty - no deadline
-	var (
-		dl, rdl, wdl, mconntime time.Duration
-		maxconn                 int64
-		toport                  int
-	)
-	if config["deadline"] != nil {
-		dlS, ok := config["deadline"].(string)
-		if !ok {
-			return nil, fmt.Errorf("invalid handler deadline %v", config["deadline"])
-		}
-		dl, err = time.ParseDuration(dlS)
-		if err != nil {
-			return nil, err
-		}
+//	Return current state and counters of handler and its servers
+//
+func (s *Handler) Status() status.Handler {
+	st := status.Handler{
+		Name:        s.Protocol + "_" + s.Port,
+		Protocol:    s.Protocol,
+		Port:        s.Port,
+		Connections: atomic.LoadUint64(&s.connectionsNumber),
+		Active:      atomic.LoadInt64(&s.currentconnectionsNumber),
+		Rejected:    atomic.LoadUint64(&s.rejected),
+		Accept:      s.Config().Accept.Strings(),
+		Deny:        s.Config().Deny.Strings(),
 	}
-	if config["readdeadline"] != nil {
-		rdlS, ok := config["readdeadline"].(string)
-		if !ok {
-			return nil, fmt.Errorf("invalid handler readdeadline %v", config["readdeadline"])
-		}
-		rdl, err = time.ParseDuration(rdlS)
-		if err != nil {
-			return nil, err
-		}
+	s.Config().eachPool(func(name string, p *Pool) {
+		st.Pools = append(st.Pools, p.Status(name))
+	})
+	return st
+}
+
+//	Enable or disable servers with address addr in all pools of handler
+//	Return number of changed servers
+//
+func (s *Handler) SetServerEnabled(addr string, enabled bool) int {
+	n := 0
+	s.Config().eachPool(func(_ string, p *Pool) {
+		n += p.SetEnabled(addr, enabled)
+	})
+	return n
+}
+
+//	Add addresses to accept or deny list of handler or remove they from list
+//	Changes are lost on reload, config files are not changed
+//
+func (s *Handler) UpdateSources(list string, addrs []string, remove bool) error {
+	c := s.Config()
+	switch list {
+	case "accept":
+		return c.Accept.Update(addrs, remove)
+	case "deny":
+		return c.Deny.Update(addrs, remove)
 	}
-	if config["writedeadline"] != nil {
-		wdlS, ok := config["writedeadline"].(string)
-		if !ok {
-			return nil, fmt.Errorf("invalid handler writedeadline %v", config["writedeadline"])
-		}
-		wdl, err = time.ParseDuration(wdlS)
-		if err != nil {
-			return nil, err
-		}
+	return fmt.Errorf("unknown list %s, must be accept or deny", list)
+}
+
+//	Put servers with address addr in maintenance in all pools of handler
+//	Return number of changed servers
+//
+func (s *Handler) SetServerMaintenance(addr string) int {
+	n := 0
+	s.Config().eachPool(func(_ string, p *Pool) {
+		n += p.SetMaintenance(addr)
+	})
+	return n
+}
+
+//	Set weight of servers with address addr in all pools of handler
+//	Return number of changed servers
+//
+func (s *Handler) SetServerWeight(addr string, weight int) int {
+	n := 0
+	s.Config().eachPool(func(_ string, p *Pool) {
+		n += p.SetWeight(addr, weight)
+	})
+	return n
+}
+
+//	Add servers of config to pool with name from status, name can be empty if handler has one pool
+//	Return number of added servers. Changes are lost on reload, config files are not changed
+//
+func (s *Handler) AddServer(pool string, c config.Server) (int, error) {
+	p, err := s.Config().findPool(pool)
+	if err != nil {
+		return 0, err
 	}
-	// parse max time to connect server. if not exist infinity
-	if config["maxconnectionstime"] != nil {
-		mconntimeS, ok := config["maxconnectionstime"].(string)
-		if !ok {
-			return nil, fmt.Errorf("invalid handler maxconnectionstime %v", config["maxconnectionstime"])
-		}
-		mconntime, err = time.ParseDuration(mconntimeS)
-		if err != nil {
-			return nil, err
+	return p.AddServer(c)
+}
+
+//	Remove servers with address addr from pool with name from status, from all pools if name is empty
+//	Return number of removed servers
+//
+func (s *Handler) RemoveServer(pool, addr string) (int, error) {
+	n := 0
+	var err error
+	s.Config().eachPool(func(name string, p *Pool) {
+		if err != nil || (pool != "" && name != pool) {
+			return
 		}
-	}
-	// parse max connections number. if not exist infinity
-	if config["maxconnections"] != nil {
-		maxconn, ok = config["maxconnections"].(int64)
-		if !ok {
-			return nil, fmt.Errorf("invalid handler maxconnections %v", config["maxconnections"])
+		var removed int
+		removed, err = p.RemoveServer(addr)
+		n += removed
+	})
+	return n, err
+}
+
+//	Return pool with name from status
+//	Empty name means the only pool of config
+//
+func (c *Config) findPool(name string) (*Pool, error) {
+	var pool *Pool
+	n := 0
+	c.eachPool(func(poolName string, p *Pool) {
+		n++
+		if poolName == name || name == "" {
+			pool = p
 		}
+	})
+	if name == "" && n > 1 {
+		return nil, fmt.Errorf("handler has %d pools, pool name is required", n)
 	}
-	// parse destination port on servers
-	if config["toport"] != nil {
-		toport, ok = config["toport"].(int)
-		if !ok {
-			return nil, fmt.Errorf("invalid handler destiantion port %v", config["toport"])
-		}
+	if pool == nil {
+		return nil, fmt.Errorf("pool %s not found", name)
 	}
+	return pool, nil
+}
 
-	// parse ip filters (clients can be filtered by source address and they requests sends to different servers)
-	filters := make([]*IPFilter, 0)
-	filtersStr, ok := config["ipfilters"].([]map[string]interface{})
-	if ok {
-		for i := 0; i < len(filtersStr); i++ {
-			srvs := make([]*Server, 0)
-			serversStr, ok := filtersStr[i]["servers"].([]map[string]interface{})
-			if ok {
-				for i := 0; i < len(serversStr); i++ {
-					srvss, err := ServersFromMap(serversStr[i], logDir)
-					if err != nil {
-						return nil, err
-					}
-					srvs = append(srvs, srvss...)
-				}
-			}
-			balancingStr, ok := filtersStr[i]["balancing"].(string)
-			if ok {
-				balancingStr = ""
-			}
-			pool, err := NewPool(srvs, balancingStr)
-			if err != nil {
-				return nil, err
-			}
+//	Call f for every servers pool of config
+//
+func (c *Config) eachPool(f func(name string, p *Pool)) {
+	f("servers", c.Servers)
+	for i, filter := range c.IPFilter {
+		f(fmt.Sprintf("ipfilter %d", i), filter.Servers())
+	}
+}
 
-			var source *client.Sources
-			sourceStr, ok := filtersStr[i]["source"].([]string)
-			if ok {
-				source, err = client.New(sourceStr...)
-				if err != nil {
-					return nil, err
-				}
-			}
-			filter := NewFilter(pool, source)
-			filters = append(filters, filter)
-		}
+//	Marshal handler with current config
+//
+func (s *Handler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Protocol string
+		Port     string
+		*Config
+	}{s.Protocol, s.Port, s.Config()})
+}
 
+//	Create log file, bind listener and run handler job gorutine
+//
+func (s *Handler) Listen() error {
+	logger, err := openLog(s.Config().LogPath)
+	if err != nil {
+		return err
+	}
+	s.logger = logger
+	if s.isPacket() {
+		err = s.listenPacket()
+	} else {
+		err = s.listenStream()
 	}
-
-	// create logger
-	logFile := fmt.Sprintf("%s/%s_%s.log", logDir, protocol, port)
-	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	logger := log.New(file, " ", log.LstdFlags)
-	logger.SetFlags(log.LstdFlags)
+	s.Config().eachPool(func(_ string, p *Pool) {
+		p.Start()
+	})
+	return nil
+}
 
-	return &Handler{
-		Protocol: protocol,
-		Port:     port,
-		logger:   logger,
+func (s *Handler) listenStream() error {
+	listener, err := net.Listen(s.Protocol, fmt.Sprintf("0.0.0.0:%s", s.Port))
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	go s.listen()
+	return nil
+}
 
-		Toport:         toport,
-		Accept:         accept,
-		Deny:           deny,
-		Servers:        pool,
-		IPFilter:       filters,
-		DeadLine:       dl,
-		WriteDeadLine:  wdl,
-		ReadDeadLine:   rdl,
-		MaxConnectTime: mconntime,
-		MaxConnections: maxconn,
-	}, err
+//	Stop accepting new connections
+//	Already accepted connections are not closed
+//
+func (s *Handler) Close() error {
+	s.Config().eachPool(func(_ string, p *Pool) {
+		p.Stop()
+	})
+	if s.packetConn != nil {
+		// udp sessions can not live without listener, replies are sent through it
+		err := s.packetConn.Close()
+		s.conns.closeAll()
+		return err
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
 
+//	Connect to server of pool
+//	If connect fails server is skipped and next server is tried until retry
+//	budget is spent or total connect timeout is reached
+//	Returned error contains reasons of all failed attempts
+//
+func (s *Handler) connect(c *Config, pool *Pool, clientAddr string) (*Server, net.Conn, error) {
+	var deadline time.Time
+	if c.ConnectTimeout != 0 {
+		deadline = time.Now().Add(c.ConnectTimeout)
+	}
+	// client must go to same server from any port
+	clientAddr = hashkey.Host(clientAddr)
+	tried := make(map[*Server]bool)
+	reasons := make([]string, 0)
+	// servers with open circuit breaker are skipped without spending retry budget
+	attempts := 0
+	for c.Retries < 0 || attempts <= c.Retries {
+		srv, err := pool.FindServerExcept(clientAddr, tried)
+		if err != nil {
+			if len(tried) == 0 {
+				return nil, nil, err
+			}
+			break
+		}
+		tried[srv] = true
+		var timeout time.Duration
+		if !deadline.IsZero() {
+			timeout = time.Until(deadline)
+			if timeout <= 0 {
+				reasons = append(reasons, "connect timeout reached")
+				break
+			}
+		}
+		conn, err := srv.Connect(s.Protocol, strconv.Itoa(c.Toport), timeout)
+		if err == nil {
+			return srv, conn, nil
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %v", srv.Addr, err))
+		if errors.Is(err, breaker.ErrOpen) {
+			continue
+		}
+		attempts++
+		// full server is not broken
+		if !errors.Is(err, backend.ErrFull) {
+			pool.Report(srv, true)
+		}
+	}
+	return nil, nil, fmt.Errorf("all servers failed: %s", strings.Join(reasons, "; "))
 }
 
-//	Run handler job gorutine
+//	Return true if handler works with datagrams
 //
-func (s *Handler) Listen() {
-	go s.listen()
+func (s *Handler) isPacket() bool {
+	return s.Protocol == "udp4" || s.Protocol == "udp6"
 }
 
-//	Get requests conn and delegate they to handle function
+//	Stop accepting new connections and wait until active connections end
+//	Waiting time is limited by ctx and by handler grace period,
+//	connections that are still active after that are closed
 //
-func (s *Handler) listen() error {
-	listener, err := net.Listen(s.Protocol, fmt.Sprintf("0.0.0.0:%s", s.Port))
-	if err != nil {
+func (s *Handler) Shutdown(ctx context.Context) error {
+	if grace := s.Config().GracePeriod; grace > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, grace)
+		defer cancel()
+	}
+	if s.packetConn != nil {
+		return s.shutdownPacket(ctx)
+	}
+	err := s.Close()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	select {
+	case <-s.conns.close():
 		return err
+	case <-ctx.Done():
+		s.conns.closeAll()
+		return ctx.Err()
 	}
+}
 
+//	Get requests conn and delegate they to handle function
+//
+func (s *Handler) listen() {
 	for {
-		conn, err := listener.Accept()
+		conn, err := s.listener.Accept()
 		if err != nil {
-			return err
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Println(err)
+			continue
 		}
 		go s.handle(conn)
 	}
@@ -296,13 +469,19 @@ func (s *Handler) listen() error {
 //
 //
 func (s *Handler) handle(client net.Conn) {
+	c := s.Config()
+	if !s.conns.add(client) {
+		client.Close()
+		return
+	}
+	defer s.conns.remove(client)
 	// if max connections reached client will be wait or request will be rejected (reject default)
 	atomic.AddUint64(&s.connectionsNumber, 1)
-	if s.MaxConnections != 0 && atomic.LoadInt64(&s.currentconnectionsNumber) >= s.MaxConnections {
-		switch s.OverFlow {
+	if c.MaxConnections != 0 && atomic.LoadInt64(&s.currentconnectionsNumber) >= c.MaxConnections {
+		switch c.OverFlow {
 		case "wait":
 			for {
-				if atomic.LoadInt64(&s.currentconnectionsNumber) <= s.MaxConnections {
+				if atomic.LoadInt64(&s.currentconnectionsNumber) <= c.MaxConnections {
 					break
 				} else {
 					time.Sleep(2 * time.Second)
@@ -318,11 +497,11 @@ func (s *Handler) handle(client net.Conn) {
 
 	//	Check is accepted client address
 	//
-	if s.Accept != nil && !s.Accept.Contains(client.RemoteAddr().String()) {
+	if c.Accept.Len() != 0 && !c.Accept.Contains(client.RemoteAddr().String()) {
 		client.Close()
 		atomic.AddUint64(&s.rejected, 1)
 		return
-	} else if s.Deny.Contains(client.RemoteAddr().String()) {
+	} else if c.Deny.Len() != 0 && c.Deny.Contains(client.RemoteAddr().String()) {
 		client.Close()
 		atomic.AddUint64(&s.rejected, 1)
 		return
@@ -332,21 +511,21 @@ func (s *Handler) handle(client net.Conn) {
 	//	Check and set deadlines
 	//
 	start := time.Now()
-	if s.DeadLine != 0 {
-		client.SetDeadline(start.Add(s.DeadLine))
+	if c.DeadLine != 0 {
+		client.SetDeadline(start.Add(c.DeadLine))
 		fmt.Println("as")
 	}
-	if s.ReadDeadLine != 0 {
-		client.SetReadDeadline(start.Add(s.ReadDeadLine))
+	if c.ReadDeadLine != 0 {
+		client.SetReadDeadline(start.Add(c.ReadDeadLine))
 	}
-	if s.WriteDeadLine != 0 {
-		client.SetWriteDeadline(start.Add(s.WriteDeadLine))
+	if c.WriteDeadLine != 0 {
+		client.SetWriteDeadline(start.Add(c.WriteDeadLine))
 	}
 
 	//	Compare client ip and servers
-	srvpool := s.Servers
-	for i := 0; i < len(s.IPFilter); i++ {
-		pool := s.IPFilter[i].Contains(client.RemoteAddr().String())
+	srvpool := c.Servers
+	for i := 0; i < len(c.IPFilter); i++ {
+		pool := c.IPFilter[i].Contains(client.RemoteAddr().String())
 		if pool != nil {
 			srvpool = pool
 			break
@@ -354,24 +533,24 @@ func (s *Handler) handle(client net.Conn) {
 	}
 
 	//	Find available server and connect to they
-	var err error
-	var srv *Server
-	var server net.Conn
-	for i := 0; i < len(srvpool.Servers) && server == nil; i++ {
-		srv, err = srvpool.FindServer(client.RemoteAddr().String())
-		if err != nil {
-			client.Close()
-			fmt.Println(err)
-			return
-		}
-		server, err = srv.Connect(s.Protocol, strconv.Itoa(s.Toport))
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	srv, server, err := s.connect(c, srvpool, client.RemoteAddr().String())
+	if err != nil {
+		s.logger.Printf("%s: %v", client.RemoteAddr(), err)
+		client.Close()
+		atomic.AddInt64(&s.currentconnectionsNumber, -1)
+		return
 	}
 
-	srv.Exchange(client, server)
+	if !s.conns.add(server) {
+		client.Close()
+		server.Close()
+		srv.Done()
+		atomic.AddInt64(&s.currentconnectionsNumber, -1)
+		return
+	}
+	err = srv.Exchange(client, server)
+	srvpool.Report(srv, err != nil)
+	s.conns.remove(server)
 
 	atomic.AddInt64(&s.currentconnectionsNumber, -1)
 }
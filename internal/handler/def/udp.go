@@ -0,0 +1,252 @@
+package def
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Max size of udp datagram
+//
+const maxDatagramSize = 65535
+
+// Udp client session
+// Every client address has own socket to server, so replies of server
+// can be sent back to the client that sent request
+//
+type session struct {
+	client  net.Addr
+	server  net.Conn
+	srv     *Server
+	timeout time.Duration
+	// unix time in nanoseconds of last datagram from client or server
+	lastActive int64
+	// pool of server, result of session is reported to it
+	pool *Pool
+	// 1 if server refused datagrams or socket to server failed
+	failed int32
+}
+
+// Sessions by client address
+//
+type sessionTable struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		sessions: make(map[string]*session),
+	}
+}
+
+func (t *sessionTable) get(addr string) *session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[addr]
+}
+
+func (t *sessionTable) set(addr string, sess *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[addr] = sess
+}
+
+//	Delete session if it is still session of address
+//	Expired session must not delete new session of the same client
+//
+func (t *sessionTable) delete(addr string, sess *session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessions[addr] == sess {
+		delete(t.sessions, addr)
+	}
+}
+
+func (s *session) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+//	Return how long session is idle
+//
+func (s *session) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+//	Bind packet listener and run handler job gorutine
+//
+func (s *Handler) listenPacket() error {
+	conn, err := net.ListenPacket(s.Protocol, net.JoinHostPort("", s.Port))
+	if err != nil {
+		return err
+	}
+	s.packetConn = conn
+	go s.servePacket()
+	return nil
+}
+
+//	Read datagrams from clients and send they to servers of client sessions
+//	New session is created for first datagram of client
+//
+func (s *Handler) servePacket() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.packetConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Println(err)
+			continue
+		}
+		sess := s.sessions.get(addr.String())
+		if sess == nil {
+			sess = s.newSession(addr)
+			if sess == nil {
+				continue
+			}
+		}
+		sess.touch()
+		_, err = sess.server.Write(buf[:n])
+		if errors.Is(err, net.ErrClosed) {
+			// session expired right now, datagram starts new session
+			s.sessions.delete(addr.String(), sess)
+			sess = s.newSession(addr)
+			if sess == nil {
+				continue
+			}
+			_, err = sess.server.Write(buf[:n])
+		}
+		if err != nil {
+			atomic.StoreInt32(&sess.failed, 1)
+			s.logger.Println(err)
+		}
+	}
+}
+
+//	Check client, find server and create session
+//	Return nil if datagram must be dropped
+//
+func (s *Handler) newSession(addr net.Addr) *session {
+	c := s.Config()
+	clientAddr := addr.String()
+	atomic.AddUint64(&s.connectionsNumber, 1)
+	// there is nothing to wait for in datagram mode, so overflow always rejects
+	if c.MaxConnections != 0 && atomic.LoadInt64(&s.currentconnectionsNumber) >= c.MaxConnections {
+		atomic.AddUint64(&s.rejected, 1)
+		return nil
+	}
+	if c.Accept.Len() != 0 && !c.Accept.Contains(clientAddr) {
+		atomic.AddUint64(&s.rejected, 1)
+		return nil
+	} else if c.Deny.Len() != 0 && c.Deny.Contains(clientAddr) {
+		atomic.AddUint64(&s.rejected, 1)
+		return nil
+	}
+
+	srvpool := c.Servers
+	for i := 0; i < len(c.IPFilter); i++ {
+		pool := c.IPFilter[i].Contains(clientAddr)
+		if pool != nil {
+			srvpool = pool
+			break
+		}
+	}
+
+	srv, server, err := s.connect(c, srvpool, clientAddr)
+	if err != nil {
+		s.logger.Printf("%s: %v", clientAddr, err)
+		return nil
+	}
+	// handler is shutting down
+	if !s.conns.add(server) {
+		server.Close()
+		srv.Done()
+		return nil
+	}
+	atomic.AddInt64(&s.currentconnectionsNumber, 1)
+
+	sess := &session{
+		client:  addr,
+		server:  server,
+		srv:     srv,
+		pool:    srvpool,
+		timeout: c.SessionTimeout,
+	}
+	sess.touch()
+	s.sessions.set(clientAddr, sess)
+	go s.serveSession(sess)
+	return sess
+}
+
+//	Send replies of server to client until session is idle longer than timeout
+//
+func (s *Handler) serveSession(sess *session) {
+	defer s.closeSession(sess)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		sess.server.SetReadDeadline(time.Now().Add(sess.timeout - sess.idle()))
+		n, err := sess.server.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			// client can be still active even if server does not reply
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if sess.idle() < sess.timeout {
+					continue
+				}
+				return
+			}
+			// socket is closed by handler on shutdown, other errors
+			// like icmp port unreachable are errors of server
+			if !errors.Is(err, net.ErrClosed) {
+				atomic.StoreInt32(&sess.failed, 1)
+			}
+			return
+		}
+		sess.touch()
+		_, err = s.packetConn.WriteTo(buf[:n], sess.client)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Println(err)
+		}
+	}
+}
+
+func (s *Handler) closeSession(sess *session) {
+	s.sessions.delete(sess.client.String(), sess)
+	sess.server.Close()
+	s.conns.remove(sess.server)
+	sess.srv.Done()
+	sess.pool.Report(sess.srv, atomic.LoadInt32(&sess.failed) == 1)
+	atomic.AddInt64(&s.currentconnectionsNumber, -1)
+}
+
+//	Stop creating new sessions and wait until active sessions expire
+//	Listener is open while waiting, so servers replies reach clients
+//
+func (s *Handler) shutdownPacket(ctx context.Context) error {
+	s.Config().eachPool(func(_ string, p *Pool) {
+		p.Stop()
+	})
+	select {
+	case <-s.conns.close():
+		return s.closePacket()
+	case <-ctx.Done():
+		s.closePacket()
+		s.conns.closeAll()
+		return ctx.Err()
+	}
+}
+
+func (s *Handler) closePacket() error {
+	err := s.packetConn.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
@@ -1,43 +1,202 @@
 package handler
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/averageNetAdmin/andproxy/internal/config"
+	"github.com/averageNetAdmin/andproxy/internal/dns"
 	"github.com/averageNetAdmin/andproxy/internal/handler/def"
 	myhttp "github.com/averageNetAdmin/andproxy/internal/handler/http"
+	"github.com/averageNetAdmin/andproxy/internal/status"
 )
 
 type Handler interface {
-	Listen()
+	Listen() error
+	Close() error
+	Shutdown(ctx context.Context) error
+	// current state and counters
+	Status() status.Handler
+	// enable or disable servers with address addr, return number of changed servers
+	SetServerEnabled(addr string, enabled bool) int
+	// put servers with address addr in maintenance, return number of changed servers
+	SetServerMaintenance(addr string) int
+	// set weight of servers with address addr, return number of changed servers
+	SetServerWeight(addr string, weight int) int
+	// add servers to pool with name from status, name can be empty if handler has one pool,
+	// return number of added servers
+	AddServer(pool string, c config.Server) (int, error)
+	// remove servers with address addr from pool, from all pools if pool is empty
+	RemoveServer(pool, addr string) (int, error)
+	// add addresses to accept or deny list or remove they from list
+	UpdateSources(list string, addrs []string, remove bool) error
 }
 
-func NewHandler(filePath string) (Handler, error) {
-	ind := strings.LastIndex(filePath, "/")
-	if ind == -1 {
-		return nil, fmt.Errorf("error parsing file path: invalid file path %s", filePath)
+//	Create handler from file
+//	File name must be in format <protocol>_<port>, for example http_80 or tcp4_22
+//	References in file are resolved with global config, it can be nil
+//
+func NewHandler(filePath string, global *config.Config) (Handler, error) {
+	name := filepath.Base(filePath)
+	_, _, err := parseName(name)
+	if err != nil {
+		return nil, err
 	}
-	fileParts := strings.Split(filePath[ind+1:], "_")
+	conf, src, err := config.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	h, err := New(name, conf, src, global)
+	if err != nil {
+		// config errors already contain file name and line
+		if _, ok := err.(config.ErrorList); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	return h, nil
+}
 
-	switch fileParts[0] {
+//	Create handler with name <protocol>_<port> from config map
+//	Config is checked before handler is created, src is used to report errors
+//
+func New(name string, conf map[string]interface{}, src *config.Source, global *config.Config) (Handler, error) {
+	protocol, port, err := parseName(name)
+	if err != nil {
+		return nil, err
+	}
+	err = global.Resolve(name, conf, src)
+	if err != nil {
+		return nil, err
+	}
+
+	switch protocol {
 	case "tcp4", "tcp6", "udp4", "udp6":
-		h, err := def.NewHandler(filePath, fileParts[0], fileParts[1])
+		c, err := config.DecodeTCP(conf, src)
 		if err != nil {
 			return nil, err
 		}
-		return h, nil
-	case "http":
-		h, err := myhttp.NewHandler(filePath, fileParts[1], false)
+		h, err := def.NewHandler(c, protocol, port)
 		if err != nil {
 			return nil, err
 		}
 		return h, nil
-	case "https":
-		h, err := myhttp.NewHandler(filePath, fileParts[1], true)
+	case "http", "https":
+		c, err := config.DecodeHTTP(conf, src)
+		if err != nil {
+			return nil, err
+		}
+		h, err := myhttp.NewHandler(c, port, protocol == "https")
 		if err != nil {
 			return nil, err
 		}
 		return h, nil
 	}
-	return nil, nil
+	return nil, fmt.Errorf("error parsing handler name %s: unknown protocol %s", name, protocol)
+}
+
+//	Update running handler with config of fresh parsed handler n
+//	Listener of running handler is not rebound and in-flight connections
+//	keep using old config until they close
+//	Return error if handler can not be updated without rebinding
+//
+func Reload(running, n Handler) error {
+	switch h := running.(type) {
+	case *def.Handler:
+		nh, ok := n.(*def.Handler)
+		if !ok {
+			return fmt.Errorf("handler type changed")
+		}
+		return h.Reload(nh)
+	case *myhttp.Handler:
+		nh, ok := n.(*myhttp.Handler)
+		if !ok {
+			return fmt.Errorf("handler type changed")
+		}
+		return h.Reload(nh)
+	}
+	return fmt.Errorf("unknown handler type %T", running)
+}
+
+//	Create handlers from all files in directory and from listen ports of global config
+//	Handlers returned by name. If handler can not be created it is skipped
+//	and the error is returned in errs by handler name (or by file path if
+//	file name is invalid), so one bad file does not block the others
+//	Hidden files and subdirectories are ignored
+//	err is returned only if directory can not be read, directory that
+//	does not exist is the same as empty directory
+//	Resolver of global config is used for server host names from now on
+//
+func NewHandlers(dir string, global *config.Config) (handlers map[string]Handler, errs map[string]error, err error) {
+	handlers = make(map[string]Handler)
+	errs = make(map[string]error)
+	resolver := ""
+	if global != nil {
+		resolver = global.Global.Resolver
+	}
+	dns.SetDefault(dns.NewResolver(resolver))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		filePath := filepath.Join(dir, entry.Name())
+		h, err := NewHandler(filePath, global)
+		if err != nil {
+			if _, _, nameErr := parseName(entry.Name()); nameErr != nil {
+				errs[filePath] = err
+			} else {
+				errs[entry.Name()] = err
+			}
+			continue
+		}
+		handlers[entry.Name()] = h
+	}
+
+	if global == nil {
+		return handlers, errs, nil
+	}
+	for listenPort, conf := range global.ListenPorts {
+		name := config.HandlerName(listenPort)
+		if _, ok := handlers[name]; ok {
+			delete(handlers, name)
+			errs[name] = fmt.Errorf("handler %s defined in both handler file and listen ports", name)
+			continue
+		}
+		if _, ok := errs[name]; ok {
+			continue
+		}
+		h, err := New(name, conf, global.ListenPortSource(listenPort), global)
+		if err != nil {
+			if _, ok := err.(config.ErrorList); !ok {
+				err = fmt.Errorf("listen port %s: %v", listenPort, err)
+			}
+			errs[name] = err
+			continue
+		}
+		handlers[name] = h
+	}
+	return handlers, errs, nil
+}
+
+//	Split handler file name to protocol and port
+//
+func parseName(name string) (protocol, port string, err error) {
+	fileParts := strings.Split(name, "_")
+	if len(fileParts) != 2 {
+		return "", "", fmt.Errorf("error parsing file name %s: name must be in format <protocol>_<port>", name)
+	}
+	n, err := strconv.Atoi(fileParts[1])
+	if err != nil || n < 1 || n > 65535 {
+		return "", "", fmt.Errorf("error parsing file name %s: invalid port %s", name, fileParts[1])
+	}
+	return fileParts[0], fileParts[1], nil
 }
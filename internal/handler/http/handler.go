@@ -1,133 +1,399 @@
 package http
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
-	"strings"
 	"sync/atomic"
 	"time"
 
-	"gopkg.in/yaml.v3"
+	"github.com/averageNetAdmin/andproxy/internal/backend"
+	"github.com/averageNetAdmin/andproxy/internal/breaker"
+	"github.com/averageNetAdmin/andproxy/internal/client"
+	"github.com/averageNetAdmin/andproxy/internal/config"
+	"github.com/averageNetAdmin/andproxy/internal/hashkey"
+	"github.com/averageNetAdmin/andproxy/internal/status"
 )
 
 //	Separate to sites - virtula hosts
 //
 type Handler struct {
-	Secure bool
-	Port   string
-	Sites  []*Site
-	logger *log.Logger
+	Secure   bool
+	Port     string
+	logger   *log.Logger
+	listener net.Listener
+	server   *http.Server
+
+	// current *Config, replaced on reload
+	// every request use config that was current when it was received
+	config atomic.Value
 }
 
-//	Create handler from yaml file
+// Part of handler that can be changed without rebinding listener
 //
-func NewHandler(configPath, port string, secure bool) (*Handler, error) {
-	configBytes, err := ioutil.ReadFile(configPath)
-	if err != nil {
-		return nil, err
-	}
-	configBytes = []byte(strings.ToLower(string(configBytes)))
-	config := make(map[string]interface{}, 0)
-	err = yaml.Unmarshal(configBytes, config)
-	if err != nil {
-		return nil, err
-	}
+type Config struct {
+	Sites       []*Site
+	GracePeriod time.Duration
+	LogPath     string
+}
 
-	logDir, ok := config["logdir"].(string)
-	if !ok {
-		logDir = fmt.Sprintf("/var/log/andproxy/http_%s/", port)
+//	Create handler from checked config
+//
+func NewHandler(c *config.HTTPHandler, port string, secure bool) (*Handler, error) {
+	logDir := c.LogDir
+	if logDir == "" {
+		logDir = fmt.Sprintf("%s/http_%s/", config.DefaultLogDir, port)
 	}
 
 	var sites []*Site
-	sitesS, ok := config["sites"].(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("no sites avaible")
-	}
-	for k, v := range sitesS {
-		conf := v.(map[string]interface{})
-		s, err := NewSite(k, conf)
+	for k, v := range c.Sites {
+		s, err := NewSite(k, v)
 		if err != nil {
 			return nil, err
 		}
 		sites = append(sites, s)
 	}
 
-	if config["secure"] != nil && !secure {
-		secure, ok = config["secure"].(bool)
-		if !ok {
-			return nil, fmt.Errorf("invalid handler secure level %v", config["secure"])
-		}
+	grace := c.GracePeriod
+	if grace == 0 {
+		grace = config.DefaultGracePeriod
 	}
 
-	err = os.MkdirAll(logDir, 0644)
+	secure = secure || c.Secure
+
+	// log file is created on Listen, so handler can be checked without side effects
+	h := &Handler{
+		Port:   port,
+		Secure: secure,
+	}
+	h.config.Store(&Config{
+		Sites:       sites,
+		GracePeriod: grace,
+		LogPath:     fmt.Sprintf("%s/http_%s.log", logDir, port),
+	})
+	return h, nil
+
+}
+
+//	Create log directory and open log file
+//
+func openLog(logPath string) (*log.Logger, error) {
+	err := os.MkdirAll(filepath.Dir(logPath), 0644)
 	if err != nil {
 		return nil, err
 	}
-	logFile := fmt.Sprintf("%s/http_%s.log", logDir, port)
-	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, err
 	}
 	logger := log.New(file, " ", log.LstdFlags)
 	logger.SetFlags(log.LstdFlags)
+	return logger, nil
+}
+
+//	Return current handler config
+//
+func (s *Handler) Config() *Config {
+	return s.config.Load().(*Config)
+}
+
+//	Return current sites
+//
+func (s *Handler) Sites() []*Site {
+	return s.Config().Sites
+}
+
+//	Replace config with config of handler n
+//	Listener is not rebound, in-flight requests keep using old config until they end
+//
+func (s *Handler) Reload(n *Handler) error {
+	if s.Port != n.Port || s.Secure != n.Secure {
+		return fmt.Errorf("can not reload http handler on port %s from handler on port %s", s.Port, n.Port)
+	}
+	// servers keep state after reload: disabled or maintenance, health, breaker and ejection
+	st := make(backend.State)
+	s.Config().eachPool(func(_ string, p *Pool) {
+		p.SaveState(st)
+	})
+	n.Config().eachPool(func(_ string, p *Pool) {
+		p.RestoreState(st)
+	})
+	if s.listener != nil {
+		n.Config().eachPool(func(_ string, p *Pool) {
+			p.Start()
+		})
+	}
+	old := s.config.Swap(n.Config()).(*Config)
+	old.eachPool(func(_ string, p *Pool) {
+		p.Stop()
+	})
+	return nil
+}
 
-	for _, v := range sites {
-		fmt.Println(v)
+//	Return current state and counters of handler, its sites and servers
+//	Handler counters are sums of paths counters
+//
+func (s *Handler) Status() status.Handler {
+	protocol := "http"
+	if s.Secure {
+		protocol = "https"
 	}
+	st := status.Handler{
+		Name:     protocol + "_" + s.Port,
+		Protocol: protocol,
+		Port:     s.Port,
+	}
+	for _, site := range s.Sites() {
+		siteSt := status.Site{Domain: site.DomainName.String()}
+		for _, path := range site.Paths {
+			pathSt := path.Status()
+			st.Connections += pathSt.Connections
+			st.Active += pathSt.Active
+			st.Rejected += pathSt.Rejected
+			siteSt.Paths = append(siteSt.Paths, pathSt)
+		}
+		st.Sites = append(st.Sites, siteSt)
+	}
+	return st
+}
 
-	return &Handler{
-		Sites:  sites,
-		Port:   port,
-		Secure: secure,
-		logger: logger,
-	}, err
+//	Enable or disable servers with address addr in all pools of handler
+//	Return number of changed servers
+//
+func (s *Handler) SetServerEnabled(addr string, enabled bool) int {
+	n := 0
+	s.Config().eachPool(func(_ string, p *Pool) {
+		n += p.SetEnabled(addr, enabled)
+	})
+	return n
+}
 
+//	Add addresses to accept or deny list of all paths of handler or remove they from lists
+//	Changes are lost on reload, config files are not changed
+//
+func (s *Handler) UpdateSources(list string, addrs []string, remove bool) error {
+	if list != "accept" && list != "deny" {
+		return fmt.Errorf("unknown list %s, must be accept or deny", list)
+	}
+	_, err := client.New(addrs...)
+	if err != nil {
+		return err
+	}
+	for _, site := range s.Sites() {
+		for _, path := range site.Paths {
+			src := path.Accept
+			if list == "deny" {
+				src = path.Deny
+			}
+			err := src.Update(addrs, remove)
+			if err != nil {
+				return fmt.Errorf("site %s path %s: %v", site.DomainName, path.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+//	Put servers with address addr in maintenance in all pools of handler
+//	Return number of changed servers
+//
+func (s *Handler) SetServerMaintenance(addr string) int {
+	n := 0
+	s.Config().eachPool(func(_ string, p *Pool) {
+		n += p.SetMaintenance(addr)
+	})
+	return n
+}
+
+//	Set weight of servers with address addr in all pools of handler
+//	Return number of changed servers
+//
+func (s *Handler) SetServerWeight(addr string, weight int) int {
+	n := 0
+	s.Config().eachPool(func(_ string, p *Pool) {
+		n += p.SetWeight(addr, weight)
+	})
+	return n
 }
 
-//	Run handler job gorutine
+//	Add servers of config to pool with name from status, name can be empty if handler has one pool
+//	Return number of added servers. Changes are lost on reload, config files are not changed
 //
-func (s *Handler) Listen() {
+func (s *Handler) AddServer(pool string, c config.Server) (int, error) {
+	p, err := s.Config().findPool(pool)
+	if err != nil {
+		return 0, err
+	}
+	return p.AddServer(c)
+}
+
+//	Remove servers with address addr from pool with name from status, from all pools if name is empty
+//	Return number of removed servers
+//
+func (s *Handler) RemoveServer(pool, addr string) (int, error) {
+	n := 0
+	var err error
+	s.Config().eachPool(func(name string, p *Pool) {
+		if err != nil || (pool != "" && name != pool) {
+			return
+		}
+		var removed int
+		removed, err = p.RemoveServer(addr)
+		n += removed
+	})
+	return n, err
+}
+
+//	Return pool with name from status
+//	Empty name means the only pool of config
+//
+func (c *Config) findPool(name string) (*Pool, error) {
+	var pool *Pool
+	n := 0
+	c.eachPool(func(poolName string, p *Pool) {
+		n++
+		if poolName == name || name == "" {
+			pool = p
+		}
+	})
+	if name == "" && n > 1 {
+		return nil, fmt.Errorf("handler has %d pools, pool name is required", n)
+	}
+	if pool == nil {
+		return nil, fmt.Errorf("pool %s not found", name)
+	}
+	return pool, nil
+}
+
+//	Call f for every servers pool of all sites and paths
+//
+func (c *Config) eachPool(f func(name string, p *Pool)) {
+	for _, site := range c.Sites {
+		for _, path := range site.Paths {
+			path.eachPool(func(name string, p *Pool) {
+				f(fmt.Sprintf("%s %s %s", site.DomainName, path.Path, name), p)
+			})
+		}
+	}
+}
+
+//	Marshal handler with current config
+//
+func (s *Handler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Secure bool
+		Port   string
+		*Config
+	}{s.Secure, s.Port, s.Config()})
+}
+
+//	Bind listener and run handler job gorutine
+//
+func (s *Handler) Listen() error {
+	logger, err := openLog(s.Config().LogPath)
+	if err != nil {
+		return err
+	}
+	s.logger = logger
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", s.Port))
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.server = &http.Server{
+		Handler: s,
+	}
 	go s.listen()
+	s.Config().eachPool(func(_ string, p *Pool) {
+		p.Start()
+	})
+	return nil
+}
+
+//	Stop accepting new connections
+//	Requests that already in progress are not interrupted
+//
+func (s *Handler) Close() error {
+	s.Config().eachPool(func(_ string, p *Pool) {
+		p.Stop()
+	})
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	go s.server.Shutdown(context.Background())
+	return err
+}
+
+//	Stop accepting new connections and wait until active requests end
+//	Waiting time is limited by ctx and by handler grace period,
+//	connections that are still active after that are closed
+//
+func (s *Handler) Shutdown(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	if grace := s.Config().GracePeriod; grace > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, grace)
+		defer cancel()
+	}
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		s.server.Close()
+	}
+	return err
 }
 
 //	If conn must be secure - check cert
 //	Get requests and delegate they to handle function
 //
 func (s *Handler) listen() {
-
+	var err error
 	if s.Secure {
-		// load cert
-		certs := make([]tls.Certificate, 0)
-		for i := 0; i < len(s.Sites); i++ {
-			certs = append(certs, *s.Sites[i].Certificate)
+		// certificate is chosen by current sites, so it can be changed on reload
+		s.server.TLSConfig = &tls.Config{
+			GetCertificate: s.getCertificate,
 		}
+		err = s.server.ServeTLS(s.listener, "", "")
+	} else {
+		err = s.server.Serve(s.listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+		s.logger.Println(err)
+	}
+}
 
-		TLSConf := &tls.Config{
-			Certificates: certs,
+//	Find certificate of site that match requested server name
+//	If no site match, first available certificate is used
+//
+func (s *Handler) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var cert *tls.Certificate
+	sites := s.Sites()
+	for i := 0; i < len(sites); i++ {
+		if len(sites[i].Certificate.Certificate) == 0 {
+			continue
 		}
-		// create server with TLS cert
-		server := &http.Server{
-			Addr:      fmt.Sprintf(":%s", s.Port),
-			TLSConfig: TLSConf,
-			Handler:   s,
+		if sites[i].DomainName.MatchString(hello.ServerName) {
+			return sites[i].Certificate, nil
 		}
-
-		server.ListenAndServeTLS("", "")
-	} else {
-		// create serfver without cert
-		server := &http.Server{
-			Addr:    fmt.Sprintf(":%s", s.Port),
-			Handler: s,
+		if cert == nil {
+			cert = sites[i].Certificate
 		}
-		server.ListenAndServe()
 	}
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate for %s", hello.ServerName)
+	}
+	return cert, nil
 }
 
 //	handler for http.Server
@@ -141,9 +407,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fmt.Println(err)
 	}
 	var s *Site
-	for i := 0; i < len(h.Sites); i++ {
-		if h.Sites[i].DomainName.MatchString(reqSite) {
-			s = h.Sites[i]
+	sites := h.Sites()
+	for i := 0; i < len(sites); i++ {
+		if sites[i].DomainName.MatchString(reqSite) {
+			s = sites[i]
 		}
 	}
 
@@ -181,17 +448,18 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// if accept array not empty accepted only addresses contained in this array
 	// if accept array empty but deny array not empty denied addresses contained in this array
 	// else all accepted
-	if p.Accept != nil && !p.Accept.Contains(r.RemoteAddr) {
+	if p.Accept.Len() != 0 && !p.Accept.Contains(r.RemoteAddr) {
 		w.WriteHeader(500)
 		atomic.AddUint64(&p.rejected, 1)
 		return
-	} else if p.Deny != nil && p.Deny.Contains(r.RemoteAddr) {
+	} else if p.Deny.Len() != 0 && p.Deny.Contains(r.RemoteAddr) {
 		w.WriteHeader(500)
 		atomic.AddUint64(&p.rejected, 1)
 		return
 	}
 	
 	atomic.AddInt64(&p.currentconnectionsNumber, 1)
+	defer atomic.AddInt64(&p.currentconnectionsNumber, -1)
 	
 	// filter server pool by client address
 	srvpool := p.Servers
@@ -204,24 +472,38 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// find available server and get response from they
+	// servers with open circuit breaker are skipped, request body is not read by they
+	// hash balancing gets key of request, client address if key is not set
+	key := hashkey.Host(r.RemoteAddr)
+	if p.HashKey != nil {
+		key = p.HashKey.Value(r)
+	}
 	var srv *Server
 	var resp *http.Response
-	for i := 0; i < len(srvpool.Servers) && resp == nil; i++ {
-		srv, err = srvpool.FindServer(r.RemoteAddr)
+	tried := make(map[*Server]bool)
+	for resp == nil {
+		srv, err = srvpool.FindServerExcept(key, tried)
 		if err != nil {
-			w.WriteHeader(500)
-			fmt.Println(err)
+			w.WriteHeader(http.StatusBadGateway)
+			h.logger.Printf("%s: %v", r.RemoteAddr, err)
 			return
 		}
+		tried[srv] = true
 		resp, err = srv.Do(strconv.Itoa(p.Toport), r)
+		if errors.Is(err, breaker.ErrOpen) {
+			continue
+		}
 		if err != nil {
-			fmt.Println(err)
+			if !errors.Is(err, backend.ErrFull) {
+				srvpool.Report(srv, true)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			h.logger.Printf("%s: %s: %v", r.RemoteAddr, srv.Addr, err)
 			return
 		}
 	}
-	if resp == nil {
-		return
-	}
+	defer resp.Body.Close()
+	srvpool.Report(srv, gatewayError(resp.StatusCode))
 	fmt.Println(time.Since(start))
 	/*re := make([]byte, 0)
 	for {
@@ -245,6 +527,12 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		fmt.Println(err)
 	}
-	atomic.AddInt64(&p.currentconnectionsNumber, -1)
 	fmt.Println(time.Since(start))
 }
+
+//	Return true if response status means that server could not handle request
+//	Such responses are errors for outlier detection
+//
+func gatewayError(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
@@ -4,7 +4,8 @@ import (
 	"crypto/tls"
 	"fmt"
 	"regexp"
-	"strings"
+
+	"github.com/averageNetAdmin/andproxy/internal/config"
 )
 
 //	Content info about ever site
@@ -15,7 +16,10 @@ type Site struct {
 	Paths       []*Path
 }
 
-func NewSite(domainName string, config map[string]interface{}) (*Site, error) {
+//	Create site from checked config
+//	If servers are set in site config, site has one path "/"
+//
+func NewSite(domainName string, c config.Site) (*Site, error) {
 	var (
 		certificate tls.Certificate
 	)
@@ -27,43 +31,29 @@ func NewSite(domainName string, config map[string]interface{}) (*Site, error) {
 	if err != nil {
 		return nil, err
 	}
-	
+
 	// check cert validity
 	paths := make([]*Path, 0)
-	if config["certificate"] != nil && config["certificateKey"] != nil {
-		certStr, ok := config["certificate"].(string)
-		if !ok {
-			return nil, fmt.Errorf("invalid handler certificate %v", config["certificate"])
-		}
-		certKeyStr, ok := config["certificateKey"].(string)
-		if !ok {
-			return nil, fmt.Errorf("invalid handler certificate key %v", config["certificateKey"])
-		}
-		certificate, err = tls.LoadX509KeyPair(certStr, certKeyStr)
+	if c.Certificate != "" && c.CertificateKey != "" {
+		certificate, err = tls.LoadX509KeyPair(c.Certificate, c.CertificateKey)
 		if err != nil {
-			fmt.Println(err)
-			return nil, err
+			return nil, fmt.Errorf("site %s: %v", domainName, err)
 		}
 
 	}
-	if config["servers"] != nil {
-		p, err := NewPath("/", config)
+	if len(c.Servers) != 0 || c.ServersFile.Path != "" {
+		p, err := NewPath("/", c.Target)
 		if err != nil {
 			return nil, err
 		}
 		paths = append(paths, p)
 	} else {
-		for k, v := range config {
-			if strings.Contains(k, "/") {
-				conf := v.(map[string]interface{})
-				p, err := NewPath(k, conf)
-				if err != nil {
-					return nil, err
-				}
-				paths = append(paths, p)
-
+		for k, v := range c.Paths {
+			p, err := NewPath(k, v)
+			if err != nil {
+				return nil, err
 			}
-
+			paths = append(paths, p)
 		}
 	}
 
@@ -0,0 +1,157 @@
+package hashkey
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Kinds of parts of key
+//
+const (
+	literal = iota
+	remoteAddr
+	uri
+	requestURI
+	header
+	cookie
+	arg
+)
+
+// Key of request that hash balancing uses instead of client address
+// Key is template of text and variables: $remote_addr, $uri (path), $request_uri (path and query),
+// $http_<name> (header), $cookie_<name> and $arg_<name> (query parameter)
+// Variables can be written as ${name} to be followed by letters
+//
+type Key struct {
+	template string
+	parts    []part
+}
+
+type part struct {
+	kind int
+	// text of literal or name of header, cookie or query parameter
+	value string
+}
+
+//	Parse key template
+//
+func Parse(template string) (*Key, error) {
+	k := &Key{template: template}
+	for i := 0; i < len(template); {
+		j := strings.IndexByte(template[i:], '$')
+		if j < 0 {
+			k.parts = append(k.parts, part{kind: literal, value: template[i:]})
+			break
+		}
+		if j > 0 {
+			k.parts = append(k.parts, part{kind: literal, value: template[i : i+j]})
+		}
+		i += j + 1
+		var name string
+		if strings.HasPrefix(template[i:], "{") {
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("%s: } expected after variable", template)
+			}
+			name = template[i+1 : i+end]
+			i += end + 1
+		} else {
+			end := i
+			for end < len(template) && isNameChar(template[end]) {
+				end++
+			}
+			name = template[i:end]
+			i = end
+		}
+		p, err := variable(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", template, err)
+		}
+		k.parts = append(k.parts, p)
+	}
+	if len(k.parts) == 0 {
+		return nil, fmt.Errorf("key is empty")
+	}
+	return k, nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+//	Return part for variable name
+//
+func variable(name string) (part, error) {
+	switch {
+	case name == "remote_addr":
+		return part{kind: remoteAddr}, nil
+	case name == "uri":
+		return part{kind: uri}, nil
+	case name == "request_uri":
+		return part{kind: requestURI}, nil
+	case strings.HasPrefix(name, "http_") && len(name) > len("http_"):
+		// header names are written like in nginx: $http_x_user_id is X-User-Id
+		return part{kind: header, value: strings.ReplaceAll(name[len("http_"):], "_", "-")}, nil
+	case strings.HasPrefix(name, "cookie_") && len(name) > len("cookie_"):
+		return part{kind: cookie, value: name[len("cookie_"):]}, nil
+	case strings.HasPrefix(name, "arg_") && len(name) > len("arg_"):
+		return part{kind: arg, value: name[len("arg_"):]}, nil
+	}
+	return part{}, fmt.Errorf("unknown variable $%s", name)
+}
+
+//	Return key of request
+//	If all variables of key are empty, for example request has no cookie of key,
+//	address of client is returned, so such clients are not sent to one server
+//
+func (k *Key) Value(r *http.Request) string {
+	b := new(strings.Builder)
+	found := false
+	for _, p := range k.parts {
+		var v string
+		switch p.kind {
+		case literal:
+			b.WriteString(p.value)
+			continue
+		case remoteAddr:
+			v = Host(r.RemoteAddr)
+		case uri:
+			v = r.URL.Path
+		case requestURI:
+			v = r.URL.RequestURI()
+		case header:
+			v = r.Header.Get(p.value)
+		case cookie:
+			if c, err := r.Cookie(p.value); err == nil {
+				v = c.Value
+			}
+		case arg:
+			v = r.URL.Query().Get(p.value)
+		}
+		if v != "" {
+			found = true
+		}
+		b.WriteString(v)
+	}
+	if !found {
+		return Host(r.RemoteAddr)
+	}
+	return b.String()
+}
+
+//	Return template of key
+//
+func (k *Key) String() string {
+	return k.template
+}
+
+//	Return address without port, so client goes to same server from any port
+//
+func Host(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
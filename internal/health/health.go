@@ -0,0 +1,386 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/averageNetAdmin/andproxy/internal/config"
+	"github.com/averageNetAdmin/andproxy/internal/event"
+)
+
+// Values used if they are not set in check config
+//
+const (
+	DefaultInterval = 5 * time.Second
+	DefaultTimeout  = 2 * time.Second
+	DefaultRise     = 2
+	DefaultFall     = 3
+)
+
+// Max size of data that is read from server by http and script checks
+//
+const maxRead = 64 * 1024
+
+// Check of one server
+//
+type Check interface {
+	// Return error if server on addr (host:port) is not healthy
+	// Check must end when ctx is done
+	Check(ctx context.Context, addr string) error
+}
+
+// Server is healthy if connection is accepted
+//
+type tcpCheck struct{}
+
+func (c *tcpCheck) Check(ctx context.Context, addr string) error {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Server is healthy if GET request returns expected status and body matches regular expression
+// If status is not set any 2xx status is expected
+//
+type httpCheck struct {
+	path   string
+	host   string
+	status int
+	body   *regexp.Regexp
+	client *http.Client
+}
+
+func (c *httpCheck) Check(ctx context.Context, addr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+c.path, nil)
+	if err != nil {
+		return err
+	}
+	if c.host != "" {
+		req.Host = c.host
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if c.status != 0 && resp.StatusCode != c.status {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, c.status)
+	}
+	if c.status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if c.body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRead))
+	if err != nil {
+		return err
+	}
+	if !c.body.Match(body) {
+		return fmt.Errorf("body does not match %s", c.body)
+	}
+	return nil
+}
+
+// Server is healthy if all steps of script are done
+// Send step writes data, expect step reads until data is received
+//
+type scriptCheck struct {
+	steps []config.Step
+}
+
+func (c *scriptCheck) Check(ctx context.Context, addr string) error {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	buf := make([]byte, 0, 512)
+	for i, step := range c.steps {
+		if step.Send != "" {
+			_, err := conn.Write([]byte(step.Send))
+			if err != nil {
+				return fmt.Errorf("step %d: %v", i, err)
+			}
+			continue
+		}
+		expect := []byte(step.Expect)
+		for {
+			if n := bytes.Index(buf, expect); n >= 0 {
+				// data after expected is left for next steps
+				buf = append(buf[:0], buf[n+len(expect):]...)
+				break
+			}
+			if len(buf) >= maxRead {
+				return fmt.Errorf("step %d: %q not received", i, step.Expect)
+			}
+			chunk := make([]byte, 512)
+			n, err := conn.Read(chunk)
+			buf = append(buf, chunk[:n]...)
+			if err != nil && bytes.Index(buf, expect) < 0 {
+				return fmt.Errorf("step %d: %q not received: %v", i, step.Expect, err)
+			}
+		}
+	}
+	return nil
+}
+
+//	Create check from checked config
+//
+func NewCheck(c *config.HealthCheck) (Check, error) {
+	switch c.Type {
+	case "", "tcp":
+		return &tcpCheck{}, nil
+	case "http":
+		check := &httpCheck{
+			path:   c.Path,
+			host:   c.Host,
+			status: c.Status,
+			client: &http.Client{
+				// redirect is answer of checked server, it is not followed
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			},
+		}
+		if check.path == "" {
+			check.path = "/"
+		}
+		if c.Body != "" {
+			body, err := regexp.Compile(c.Body)
+			if err != nil {
+				return nil, err
+			}
+			check.body = body
+		}
+		return check, nil
+	case "script":
+		return &scriptCheck{steps: c.Script}, nil
+	default:
+		return nil, fmt.Errorf("%s health check not exist", c.Type)
+	}
+}
+
+// Health of one server
+// Server is healthy until it fails Fall checks in a row,
+// after that it is unhealthy until it passes Rise checks in a row
+//
+type State struct {
+	mu        sync.Mutex
+	down      bool
+	successes int
+	failures  int
+	lastError string
+}
+
+//	Return false if server failed health checks
+//
+func (s *State) Healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.down
+}
+
+//	Return error of last failed check, empty if last check passed
+//
+func (s *State) LastError() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastError
+}
+
+//	Take health and checks in a row of state o
+//
+func (s *State) CopyFrom(o *State) {
+	o.mu.Lock()
+	down, successes, failures, lastError := o.down, o.successes, o.failures, o.lastError
+	o.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down, s.successes, s.failures, s.lastError = down, successes, failures, lastError
+}
+
+//	Count check result
+//	Return true if server health is changed
+//
+func (s *State) report(err error, rise, fall int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.lastError = ""
+		s.failures = 0
+		s.successes++
+		if s.down && s.successes >= rise {
+			s.down = false
+			return true
+		}
+		return false
+	}
+	s.lastError = err.Error()
+	s.successes = 0
+	s.failures++
+	if !s.down && s.failures >= fall {
+		s.down = true
+		return true
+	}
+	return false
+}
+
+// Server that can be checked
+//
+type Target interface {
+	// Return ip address of server
+	Address() string
+	Health() *State
+}
+
+// Run check of pool servers periodically
+//
+type Checker struct {
+	Type     string
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int
+	Fall     int
+	Port     string
+	check    Check
+	stop     chan struct{}
+	start    sync.Once
+	close    sync.Once
+}
+
+//	Create checker from checked config
+//	port is used if port is not set in config
+//
+func NewChecker(c *config.HealthCheck, port int) (*Checker, error) {
+	check, err := NewCheck(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Port != 0 {
+		port = c.Port
+	}
+	if port == 0 {
+		return nil, fmt.Errorf("health check port is not set")
+	}
+	checker := &Checker{
+		Type:     c.Type,
+		Interval: c.Interval,
+		Timeout:  c.Timeout,
+		Rise:     c.Rise,
+		Fall:     c.Fall,
+		Port:     strconv.Itoa(port),
+		check:    check,
+		stop:     make(chan struct{}),
+	}
+	if checker.Type == "" {
+		checker.Type = "tcp"
+	}
+	if checker.Interval == 0 {
+		checker.Interval = DefaultInterval
+	}
+	if checker.Timeout == 0 {
+		checker.Timeout = DefaultTimeout
+		if checker.Timeout > checker.Interval {
+			checker.Timeout = checker.Interval
+		}
+	}
+	if checker.Rise == 0 {
+		checker.Rise = DefaultRise
+	}
+	if checker.Fall == 0 {
+		checker.Fall = DefaultFall
+	}
+	return checker, nil
+}
+
+//	Check servers returned by targets every interval until Stop is called
+//	update is called after checks if health of any server is changed
+//	Checker can be started only once
+//
+func (c *Checker) Start(targets func() []Target, update func()) {
+	c.start.Do(func() {
+		go c.run(targets, update)
+	})
+}
+
+//	Return short description of checker
+//
+func (c *Checker) String() string {
+	return fmt.Sprintf("%s check on port %s every %v, timeout %v, rise %d, fall %d",
+		c.Type, c.Port, c.Interval, c.Timeout, c.Rise, c.Fall)
+}
+
+//	Stop checking servers
+//
+func (c *Checker) Stop() {
+	c.close.Do(func() {
+		close(c.stop)
+	})
+}
+
+func (c *Checker) run(targets func() []Target, update func()) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		if c.checkAll(targets()) {
+			update()
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//	Check all servers in parallel and wait results
+//	Return true if health of any server is changed
+//
+func (c *Checker) checkAll(targets []Target) bool {
+	changed := make([]bool, len(targets))
+	wg := new(sync.WaitGroup)
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			changed[i] = c.checkOne(targets[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, ch := range changed {
+		if ch {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Checker) checkOne(t Target) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	err := c.check.Check(ctx, net.JoinHostPort(t.Address(), c.Port))
+	state := t.Health()
+	if !state.report(err, c.Rise, c.Fall) {
+		return false
+	}
+	if state.Healthy() {
+		event.Publish(event.Event{Type: event.ServerHealthy, Server: t.Address()})
+	} else {
+		event.Publish(event.Event{Type: event.ServerUnhealthy, Server: t.Address(), Message: err.Error()})
+	}
+	return true
+}
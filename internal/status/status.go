@@ -0,0 +1,112 @@
+package status
+
+// States of server
+//
+const (
+	StateUp          = "up"
+	StateBroken      = "broken"
+	StateHalfOpen    = "half-open"
+	StateUnhealthy   = "unhealthy"
+	StateDisabled    = "disabled"
+	StateStandby     = "standby"
+	StateDraining    = "draining"
+	StateMaintenance = "maintenance"
+	StateEjected     = "ejected"
+)
+
+// Current state and counters of handler
+// Tcp and udp handlers have pools, http handlers have sites
+//
+type Handler struct {
+	Name        string   `json:"name"`
+	Protocol    string   `json:"protocol"`
+	Port        string   `json:"port"`
+	Connections uint64   `json:"connections"`
+	Active      int64    `json:"active"`
+	Rejected    uint64   `json:"rejected"`
+	Accept      []string `json:"accept,omitempty"`
+	Deny        []string `json:"deny,omitempty"`
+	Pools       []Pool   `json:"pools,omitempty"`
+	Sites       []Site   `json:"sites,omitempty"`
+}
+
+// Current state of http site
+//
+type Site struct {
+	Domain string `json:"domain"`
+	Paths  []Path `json:"paths"`
+}
+
+// Current state and counters of http site path
+//
+type Path struct {
+	Path        string   `json:"path"`
+	Connections uint64   `json:"connections"`
+	Active      int64    `json:"active"`
+	Rejected    uint64   `json:"rejected"`
+	Accept      []string `json:"accept,omitempty"`
+	Deny        []string `json:"deny,omitempty"`
+	Pools       []Pool   `json:"pools"`
+}
+
+// Current state of servers pool
+//
+type Pool struct {
+	Name      string   `json:"name"`
+	Balancing string   `json:"balancing"`
+	Servers   []Server `json:"servers"`
+}
+
+// Current state and counters of server
+// Handler and Pool are set only when servers are listed without handler tree
+//
+type Server struct {
+	Handler     string `json:"handler,omitempty"`
+	Pool        string `json:"pool,omitempty"`
+	Addr        string `json:"addr"`
+	Host        string `json:"host,omitempty"`
+	Weight      int    `json:"weight"`
+	Effective   int    `json:"effectiveWeight"`
+	State       string `json:"state"`
+	Connections uint64 `json:"connections"`
+	Active      int64  `json:"active"`
+	Fails       uint64 `json:"fails"`
+	// error of last failed health check
+	Check   string  `json:"check,omitempty"`
+	Breaker Breaker `json:"breaker"`
+}
+
+// State and counters of server circuit breaker
+// Opened, HalfOpened and Closed count transitions to that state
+//
+type Breaker struct {
+	State       string `json:"state"`
+	RecentFails int    `json:"recentFails"`
+	Fails       uint64 `json:"fails"`
+	Opened      uint64 `json:"opened"`
+	HalfOpened  uint64 `json:"halfOpened"`
+	Closed      uint64 `json:"closed"`
+}
+
+//	Return all servers of handler as flat list
+//	Site and path are added to pool name of http servers
+//
+func (h *Handler) Servers() []Server {
+	srvs := make([]Server, 0)
+	add := func(prefix string, pools []Pool) {
+		for _, p := range pools {
+			for _, srv := range p.Servers {
+				srv.Handler = h.Name
+				srv.Pool = prefix + p.Name
+				srvs = append(srvs, srv)
+			}
+		}
+	}
+	add("", h.Pools)
+	for _, site := range h.Sites {
+		for _, path := range site.Paths {
+			add(site.Domain+" "+path.Path+" ", path.Pools)
+		}
+	}
+	return srvs
+}